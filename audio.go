@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/base64"
+	"log"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"ai_tg_bot/config"
+)
+
+// audioFormat is Ogg Opus, the only format Telegram plays as a voice
+// message.
+const audioFormat = "opus"
+
+// AudioOptions picks the voice and encoding of a spoken reply.
+type AudioOptions struct {
+	Voice  string `json:"voice"`
+	Format string `json:"format"`
+}
+
+// MessageAudio is the spoken reply of an audio-capable model.
+type MessageAudio struct {
+	ID         string `json:"id"`
+	Data       string `json:"data"` // base64-encoded, in the requested format
+	Transcript string `json:"transcript"`
+}
+
+// wantsAudio reports whether replies from model should be spoken: with
+// AUDIO_REPLIES on and a model known to produce audio. Only the chat
+// completions API supports this, and not while streaming.
+func wantsAudio(cfg *config.Config, model string) bool {
+	if !cfg.AudioReplies || cfg.OpenAIAPI == "responses" {
+		return false
+	}
+	info, ok := lookupModel(model)
+	return ok && info.AudioOutput
+}
+
+// sendVoiceReply sends the spoken version of a reply, if it has one.
+func sendVoiceReply(bot *tgbotapi.BotAPI, chatID int64, msg OpenAIMessage) {
+	if msg.Audio == nil || msg.Audio.Data == "" {
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(msg.Audio.Data)
+	if err != nil {
+		log.Printf("Failed to decode spoken reply: %v", err)
+		return
+	}
+	voice := tgbotapi.NewVoice(chatID, tgbotapi.FileBytes{Name: "reply.ogg", Bytes: data})
+	if _, err := bot.Send(voice); err != nil {
+		log.Printf("Failed to send spoken reply: %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// errorDeleteAfter is how long error messages stay in group chats before
+// the bot deletes them; 0 keeps them. Set at startup from the config.
+var errorDeleteAfter time.Duration
+
+// sendError sends an error message. In group chats it is deleted again
+// after errorDeleteAfter so that failed requests don't clutter the chat.
+func sendError(bot *tgbotapi.BotAPI, chatID int64, text string) {
+	sent, err := bot.Send(tgbotapi.NewMessage(chatID, text))
+	if err != nil {
+		log.Printf("Failed to send error message: %v", err)
+		return
+	}
+	// Group and supergroup chat IDs are negative.
+	if errorDeleteAfter <= 0 || chatID > 0 {
+		return
+	}
+	time.AfterFunc(errorDeleteAfter, func() {
+		if _, err := bot.Request(tgbotapi.NewDeleteMessage(chatID, sent.MessageID)); err != nil {
+			log.Printf("Failed to delete error message %d in chat %d: %v", sent.MessageID, chatID, err)
+		}
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// newAzureChatRequest returns a chatRequest for the chat completions of
+// an Azure OpenAI resource at endpoint. Azure routes by deployment rather
+// than model, so requests go to deployment, or to a deployment named like
+// the requested model if deployment is empty.
+func newAzureChatRequest(endpoint, deployment, apiVersion string) (func(ctx context.Context, apiKey, model string, body []byte) (*http.Request, error), error) {
+	if endpoint == "" {
+		return nil, errors.New("AZURE_OPENAI_ENDPOINT is not set")
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("invalid AZURE_OPENAI_ENDPOINT %q", endpoint)
+	}
+	base := strings.TrimRight(endpoint, "/")
+	query := url.Values{"api-version": {apiVersion}}.Encode()
+
+	return func(ctx context.Context, apiKey, model string, body []byte) (*http.Request, error) {
+		name := deployment
+		if name == "" {
+			name = model
+		}
+		target := fmt.Sprintf("%s/openai/deployments/%s/chat/completions?%s", base, url.PathEscape(name), query)
+		req, err := http.NewRequestWithContext(ctx, "POST", target, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("api-key", apiKey)
+		return req, nil
+	}, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// listUserIDs returns every distinct user that has data stored in the collection.
+func listUserIDs(collection *mongo.Collection) ([]int64, error) {
+	values, err := collection.Distinct(context.TODO(), "user_id", bson.M{"user_id": bson.M{"$gt": 0}})
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for _, v := range values {
+		if id, ok := v.(int64); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// broadcast sends text to every known user and reports the outcome back to
+// the admin's chat. The send governor keeps it under the flood limits.
+func broadcast(bot *tgbotapi.BotAPI, collection *mongo.Collection, adminChatID int64, lang, text string) {
+	userIDs, err := listUserIDs(collection)
+	if err != nil {
+		log.Printf("Failed to list users for broadcast: %v", err)
+		bot.Send(tgbotapi.NewMessage(adminChatID, tr(lang, "broadcast_error")))
+		return
+	}
+
+	var sent, failed int
+	for _, userID := range userIDs {
+		// In private chats the chat ID equals the user ID.
+		if _, err := bot.Send(tgbotapi.NewMessage(userID, text)); err != nil {
+			log.Printf("Broadcast to %d failed: %v", userID, err)
+			failed++
+			continue
+		}
+		sent++
+	}
+
+	bot.Send(tgbotapi.NewMessage(adminChatID, tr(lang, "broadcast_done", sent, failed)))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"ai_tg_bot/config"
+)
+
+// budgetRefreshInterval bounds how stale the aggregated spend may be.
+const budgetRefreshInterval = time.Minute
+
+// spendTracker caches the total cost of all users' requests in the
+// current UTC day and month, summed from the usage documents.
+type spendTracker struct {
+	mu           sync.Mutex
+	refreshed    time.Time
+	daily        float64
+	monthly      float64
+	notifiedIn   map[int64]string // period each user was last told about the downgrade in
+	lastExceeded string
+}
+
+var spend = &spendTracker{notifiedIn: map[int64]string{}}
+
+// totals returns the day's and month's spend, re-aggregating them when the
+// cache is older than budgetRefreshInterval. On errors the cached values
+// are kept.
+func (s *spendTracker) totals(collection *mongo.Collection) (daily, monthly float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	if now.Sub(s.refreshed) < budgetRefreshInterval && s.refreshed.Day() == now.Day() {
+		return s.daily, s.monthly
+	}
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	d, errD := sumCostSince(collection, dayStart)
+	m, errM := sumCostSince(collection, monthStart)
+	if errD != nil || errM != nil {
+		log.Printf("Failed to aggregate spend: %v, %v", errD, errM)
+		return s.daily, s.monthly
+	}
+	s.daily, s.monthly, s.refreshed = d, m, now
+	return d, m
+}
+
+func sumCostSince(collection *mongo.Collection, since time.Time) (float64, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"type": "usage", "created_at": bson.M{"$gte": since}}}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "total": bson.M{"$sum": "$cost"}}}},
+	}
+	cursor, err := collection.Aggregate(context.TODO(), pipeline)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(context.TODO())
+	var result struct {
+		Total float64 `bson:"total"`
+	}
+	if cursor.Next(context.TODO()) {
+		if err := cursor.Decode(&result); err != nil {
+			return 0, err
+		}
+	}
+	return result.Total, cursor.Err()
+}
+
+// exceededPeriod reports which budget is used up: "daily", "monthly" or ""
+// for neither. Together with the date it names the period the downgrade
+// lasts for.
+func exceededPeriod(collection *mongo.Collection, cfg *config.Config) (period, key string) {
+	if cfg.BudgetDaily <= 0 && cfg.BudgetMonthly <= 0 {
+		return "", ""
+	}
+	daily, monthly := spend.totals(collection)
+	now := time.Now().UTC()
+	switch {
+	case cfg.BudgetMonthly > 0 && monthly >= cfg.BudgetMonthly:
+		return "monthly", now.Format("2006-01")
+	case cfg.BudgetDaily > 0 && daily >= cfg.BudgetDaily:
+		return "daily", now.Format("2006-01-02")
+	}
+	return "", ""
+}
+
+// budgetModel returns the model to use for userID: model itself, or
+// BUDGET_FALLBACK_MODEL while the daily or monthly budget is used up. Each
+// user is told once per period that answers come from the cheaper model;
+// a zero chatID (inline queries) skips that.
+func budgetModel(bot *tgbotapi.BotAPI, collection *mongo.Collection, cfg *config.Config, userID, chatID int64, lang, model string) string {
+	if cfg.BudgetFallbackModel == "" || model == cfg.BudgetFallbackModel {
+		return model
+	}
+	period, key := exceededPeriod(collection, cfg)
+	if period == "" {
+		return model
+	}
+
+	spend.mu.Lock()
+	if spend.lastExceeded != key {
+		spend.lastExceeded = key
+		spend.notifiedIn = map[int64]string{}
+		log.Printf("Warning: %s budget reached, downgrading requests to %s", period, cfg.BudgetFallbackModel)
+	}
+	notify := spend.notifiedIn[userID] != key && chatID != 0
+	if notify {
+		spend.notifiedIn[userID] = key
+	}
+	spend.mu.Unlock()
+
+	if notify {
+		bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "budget_downgrade_"+period, cfg.BudgetFallbackModel)))
+	}
+	return cfg.BudgetFallbackModel
+}
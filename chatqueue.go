@@ -0,0 +1,42 @@
+package main
+
+import "sync"
+
+// chatQueues runs tasks one after another per chat, each chat on a
+// goroutine of its own that exits once the chat's queue is empty.
+type chatQueues struct {
+	mu      sync.Mutex
+	pending map[int64][]func() // present while the chat's worker runs
+}
+
+func newChatQueues() *chatQueues {
+	return &chatQueues{pending: map[int64][]func(){}}
+}
+
+// run queues task for chatID, starting the chat's worker if it is idle.
+// It never blocks on the task.
+func (q *chatQueues) run(chatID int64, task func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	tasks, busy := q.pending[chatID]
+	q.pending[chatID] = append(tasks, task)
+	if !busy {
+		go q.work(chatID)
+	}
+}
+
+func (q *chatQueues) work(chatID int64) {
+	for {
+		q.mu.Lock()
+		tasks := q.pending[chatID]
+		if len(tasks) == 0 {
+			delete(q.pending, chatID)
+			q.mu.Unlock()
+			return
+		}
+		task := tasks[0]
+		q.pending[chatID] = tasks[1:]
+		q.mu.Unlock()
+		task()
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"ai_tg_bot/config"
+)
+
+// commandScope controls where a command is advertised.
+type commandScope int
+
+const (
+	scopeAll     commandScope = iota // private chats and groups
+	scopePrivate                     // private chats only
+	scopeGroup                       // group chats only
+	scopeAdmin                       // admins' private chats only
+)
+
+type botCommand struct {
+	Name  string
+	Scope commandScope
+}
+
+// botCommands is the single source for /help and the Telegram command menu.
+// Descriptions live in the catalog under "cmd_<name>".
+var botCommands = []botCommand{
+	{Name: "start", Scope: scopePrivate},
+	{Name: "help", Scope: scopeAll},
+	{Name: "model", Scope: scopeAll},
+	{Name: "raw", Scope: scopeAll},
+	{Name: "think", Scope: scopeAll},
+	{Name: "length", Scope: scopeAll},
+	{Name: "json", Scope: scopeAll},
+	{Name: "seed", Scope: scopeAll},
+	{Name: "topp", Scope: scopeAll},
+	{Name: "params", Scope: scopeAll},
+	{Name: "reset", Scope: scopeAll},
+	{Name: "count", Scope: scopeAll},
+	{Name: "again", Scope: scopeAll},
+	{Name: "export", Scope: scopeAll},
+	{Name: "import", Scope: scopeAll},
+	{Name: "stateless", Scope: scopeAll},
+	{Name: "private", Scope: scopeAll},
+	{Name: "footer", Scope: scopeAll},
+	{Name: "verbose", Scope: scopeAll},
+	{Name: "variants", Scope: scopeAll},
+	{Name: "pick", Scope: scopeAll},
+	{Name: "session", Scope: scopePrivate},
+	{Name: "lang", Scope: scopeAll},
+	{Name: "system", Scope: scopeAll},
+	{Name: "preset", Scope: scopeAll},
+	{Name: "broadcast", Scope: scopeAdmin},
+	{Name: "export_all", Scope: scopeAdmin},
+	{Name: "debug", Scope: scopeAdmin},
+	{Name: "maintenance", Scope: scopeAdmin},
+	{Name: "lasterror", Scope: scopeAdmin},
+	{Name: "tier", Scope: scopeAdmin},
+	{Name: "version", Scope: scopeAdmin},
+	{Name: "spendcap", Scope: scopeAdmin},
+}
+
+func commandsFor(lang string, scopes ...commandScope) []tgbotapi.BotCommand {
+	var cmds []tgbotapi.BotCommand
+	for _, c := range botCommands {
+		for _, scope := range scopes {
+			if c.Scope == scope {
+				cmds = append(cmds, tgbotapi.BotCommand{Command: c.Name, Description: tr(lang, "cmd_"+c.Name)})
+				break
+			}
+		}
+	}
+	return cmds
+}
+
+// registerCommands publishes scoped command menus: private chats, group
+// chats and, for each admin, their private chat with admin commands added.
+// The default language menu has no language code; the others are shown to
+// clients using that language.
+func registerCommands(bot *tgbotapi.BotAPI, cfg *config.Config) {
+	for lang := range catalog {
+		code := lang
+		if lang == defaultLang {
+			code = ""
+		}
+		setMenu := func(scope tgbotapi.BotCommandScope, scopes ...commandScope) {
+			cmds := commandsFor(lang, scopes...)
+			if _, err := bot.Request(tgbotapi.NewSetMyCommandsWithScopeAndLanguage(scope, code, cmds...)); err != nil {
+				log.Printf("Failed to register %s commands for scope %s: %v", lang, scope.Type, err)
+			}
+		}
+
+		setMenu(tgbotapi.NewBotCommandScopeDefault(), scopeAll)
+		setMenu(tgbotapi.NewBotCommandScopeAllPrivateChats(), scopeAll, scopePrivate)
+		setMenu(tgbotapi.NewBotCommandScopeAllGroupChats(), scopeAll, scopeGroup)
+		for _, adminID := range cfg.AdminIDs {
+			setMenu(tgbotapi.NewBotCommandScopeChat(adminID), scopeAll, scopePrivate, scopeAdmin)
+		}
+	}
+}
+
+// helpText lists the commands available to the sender in this chat.
+func helpText(cfg *config.Config, message *tgbotapi.Message, lang string) string {
+	scopes := []commandScope{scopeAll}
+	if message.Chat.IsPrivate() {
+		scopes = append(scopes, scopePrivate)
+		if cfg.IsAdmin(message.From.ID) {
+			scopes = append(scopes, scopeAdmin)
+		}
+	} else {
+		scopes = append(scopes, scopeGroup)
+	}
+
+	var b strings.Builder
+	b.WriteString(tr(lang, "help_header") + "\n")
+	for _, c := range commandsFor(lang, scopes...) {
+		fmt.Fprintf(&b, "/%s — %s\n", c.Command, c.Description)
+	}
+	return b.String()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"ai_tg_bot/config"
+)
+
+// History strategies for HISTORY_STRATEGY.
+const (
+	strategyTruncate  = "truncate"
+	strategySummarize = "summarize"
+	strategyWindow    = "window"
+)
+
+const summaryInstruction = "Summarize the conversation below in a few short paragraphs, " +
+	"keeping the facts, names, decisions and open questions needed to continue it. " +
+	"Write the summary in the language of the conversation."
+
+// summaryRole marks a stored summary in history. It is sent to the model
+// as a system message, introduced by summaryPrefix.
+const summaryRole = "summary"
+
+// summaryPrefix introduces a stored summary when it is sent to the model.
+const summaryPrefix = "Summary of the earlier conversation:\n"
+
+// compactHistory shortens a session's history, the pending user message
+// last, before it is sent to model:
+//
+//   - truncate drops the oldest messages until the rest fits the model's
+//     context window;
+//   - window keeps the HISTORY_WINDOW most recent messages;
+//   - summarize, once the history grows past HISTORY_WINDOW messages,
+//     collapses the older part into a summary stored in place of those
+//     messages, falling back to truncate if that fails.
+//
+// A context-length error still drops messages after the fact (see
+// dropOldestMessages). The caller holds the user's lock.
+func compactHistory(ctx context.Context, collection *mongo.Collection, cfg *config.Config, userID int64, session, model string, history []ChatMessage) []ChatMessage {
+	switch cfg.HistoryStrategy {
+	case strategyWindow:
+		if cfg.HistoryWindow > 0 && len(history) > cfg.HistoryWindow {
+			history = history[len(history)-cfg.HistoryWindow:]
+		}
+		return history
+	case strategySummarize:
+		if cfg.HistoryWindow > 0 && len(history) > cfg.HistoryWindow {
+			summarized, err := summarizeHistory(ctx, collection, cfg, userID, session, model, history)
+			if err == nil {
+				return summarized
+			}
+			log.Printf("Failed to summarize chat history of user %d, truncating instead: %v", userID, err)
+		}
+	}
+	return truncateHistory(cfg, model, history)
+}
+
+// truncateHistory drops the oldest messages that don't fit the model's
+// context window once room for the reply is set aside. Histories for
+// models missing from the table are left as they are.
+func truncateHistory(cfg *config.Config, model string, history []ChatMessage) []ChatMessage {
+	info, ok := lookupModel(model)
+	if !ok {
+		return history
+	}
+	reserve := max(cfg.ParamsFor(model).MaxTokens, minAutoMaxTokens)
+	budget := info.ContextWindow - int(float64(info.ContextWindow)*contextSafetyMargin) - reserve
+	tokens := estimateTokens(historyMessages(history))
+	for len(history) > 1 && tokens > budget {
+		tokens -= estimateTokens(historyMessages(history[:1]))
+		history = history[1:]
+	}
+	return history
+}
+
+// summarizeHistory replaces all but the newest half of HISTORY_WINDOW
+// messages with a summary, both in history and in MongoDB. An earlier
+// summary at the start of the history is folded into the new one.
+func summarizeHistory(ctx context.Context, collection *mongo.Collection, cfg *config.Config, userID int64, session, model string, history []ChatMessage) ([]ChatMessage, error) {
+	keep := max(cfg.HistoryWindow/2, 1)
+	older := history[:len(history)-keep]
+
+	var transcript strings.Builder
+	var ids []interface{}
+	for _, msg := range older {
+		role := msg.Role
+		if role == summaryRole {
+			role = "earlier summary"
+		}
+		fmt.Fprintf(&transcript, "%s: %s\n\n", role, msg.Content)
+		if !msg.ID.IsZero() {
+			ids = append(ids, msg.ID)
+		}
+	}
+
+	if cfg.SummaryModel != "" {
+		model = budgetModel(nil, collection, cfg, userID, 0, "", cfg.SummaryModel)
+	}
+	resp, err := callOpenAI(ctx, OpenAIRequest{
+		Model: model,
+		Messages: []OpenAIMessage{
+			{Role: "system", Content: summaryInstruction},
+			{Role: "user", Content: transcript.String()},
+		},
+		User: hashUserID(cfg.UserHashSalt, userID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	recordUsage(collection, userID, resp)
+
+	// The summary takes the place of the messages it covers, so it sorts
+	// right before the first message kept, which may share its timestamp
+	// with the summarized ones (imports do).
+	at := history[len(older)].CreatedAt
+	if !at.IsZero() {
+		at = at.Add(-time.Millisecond)
+	}
+	summary := ChatMessage{
+		UserID:    userID,
+		Session:   session,
+		Role:      summaryRole,
+		Content:   resp.Choices[0].Message.Content,
+		CreatedAt: at,
+	}
+	if err := appendChatMessages(collection, userID, session, summary); err != nil {
+		return nil, err
+	}
+	if len(ids) > 0 {
+		if _, err := collection.DeleteMany(context.TODO(), bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+			log.Printf("Failed to delete summarized messages of user %d: %v", userID, err)
+		}
+	}
+	return append([]ChatMessage{summary}, history[len(older):]...), nil
+}
+
+// historyMessages converts stored messages to the form sent to OpenAI.
+func historyMessages(history []ChatMessage) []OpenAIMessage {
+	messages := make([]OpenAIMessage, 0, len(history))
+	for _, msg := range history {
+		if msg.Role == summaryRole {
+			messages = append(messages, OpenAIMessage{Role: "system", Content: summaryPrefix + msg.Content})
+			continue
+		}
+		messages = append(messages, OpenAIMessage{Role: msg.Role, Content: msg.Content})
+	}
+	return messages
+}
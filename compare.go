@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"ai_tg_bot/config"
+)
+
+// parseCompareArgs splits the arguments of /model compare into the two
+// models and the prompt.
+func parseCompareArgs(args string) (models [2]string, prompt string, ok bool) {
+	fields := strings.Fields(args)
+	if len(fields) < 4 || fields[0] != "compare" {
+		return models, "", false
+	}
+	models = [2]string{fields[1], fields[2]}
+	prompt = args
+	for _, field := range fields[:3] {
+		prompt = strings.TrimSpace(prompt)
+		prompt = strings.TrimPrefix(prompt, field)
+	}
+	return models, strings.TrimSpace(prompt), true
+}
+
+// compareModels sends prompt to both models at once and replies with the
+// two answers, each labeled with its model. Like /raw, nothing is stored
+// and the quota counts the command once; usage is recorded per model. A
+// model that fails shows its error in place of the answer.
+func compareModels(bot *tgbotapi.BotAPI, collection *mongo.Collection, cfg *config.Config, requestID int, userID, chatID int64, lang string, models [2]string, prompt string) {
+	if !allowInput(bot, userID, chatID, lang, prompt) {
+		return
+	}
+	mu := userLock(userID)
+	mu.Lock()
+	allowed := checkDailyQuota(bot, collection, cfg, userID, chatID, lang)
+	mu.Unlock()
+	if !allowed {
+		return
+	}
+
+	// Past the budget both answers come from the fallback model, which
+	// still shows what the user would get.
+	for i, model := range models {
+		models[i] = budgetModel(bot, collection, cfg, userID, chatID, lang, model)
+	}
+
+	ctx, cancel := requestContext(cfg, userID)
+	defer cancel()
+	stopNotice := notifyAfter(cfg.RequestSoftDeadline, func() {
+		bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "still_working")))
+	})
+
+	var answers [2]string
+	var wg sync.WaitGroup
+	for i, model := range models {
+		wg.Add(1)
+		go func(i int, model string) {
+			defer wg.Done()
+			req := OpenAIRequest{
+				Model:    model,
+				Messages: []OpenAIMessage{{Role: "user", Content: prompt}},
+				User:     hashUserID(cfg.UserHashSalt, userID),
+			}
+			resp, err := callOpenAI(ctx, req)
+			if err != nil {
+				recordOpenAIError(userID, requestID, err)
+				answers[i] = "⚠️ " + openAIErrorText(lang, err)
+				return
+			}
+			recordUsage(collection, userID, resp)
+			answers[i] = brandReply(cfg, resp.Choices[0].Message.Content)
+		}(i, model)
+	}
+	wg.Wait()
+	stopNotice()
+
+	var b strings.Builder
+	for i, model := range models {
+		if i > 0 {
+			b.WriteString("\n\n")
+		}
+		b.WriteString(tr(lang, "compare_header", model))
+		b.WriteString("\n\n")
+		b.WriteString(answers[i])
+	}
+	sendLongMessage(bot, chatID, b.String())
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	"ai_tg_bot/config"
+)
+
+// checkContentFilter turns a reply cut off by the content filter into
+// ErrContentFiltered.
+func checkContentFilter(resp *OpenAIResponse) error {
+	for _, choice := range resp.Choices {
+		if choice.FinishReason == "content_filter" {
+			return ErrContentFiltered
+		}
+	}
+	return nil
+}
+
+// withFilterFallback sends request(model) and, if the content filter
+// blocks the reply, retries once with CONTENT_FILTER_FALLBACK_MODEL, since
+// models differ in how eagerly they filter. beforeRetry, if not nil, runs
+// before the retry, e.g. to discard a partly streamed reply.
+func withFilterFallback(cfg *config.Config, model string, request func(model string) (*OpenAIResponse, error), beforeRetry func()) (*OpenAIResponse, error) {
+	resp, err := request(model)
+	fallback := cfg.ContentFilterFallbackModel
+	if !errors.Is(err, ErrContentFiltered) || fallback == "" || fallback == model {
+		return resp, err
+	}
+	log.Printf("Reply of %s blocked by the content filter, retrying with %s", model, fallback)
+	if beforeRetry != nil {
+		beforeRetry()
+	}
+	return request(fallback)
+}
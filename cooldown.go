@@ -0,0 +1,38 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type cooldownKey struct {
+	userID  int64
+	command string
+}
+
+var (
+	cooldownMu sync.Mutex
+	lastUsed   = map[cooldownKey]time.Time{}
+)
+
+// checkCooldown returns how long userID must still wait before running
+// command again. A zero result means the command may run and the use is
+// recorded.
+func checkCooldown(userID int64, command string, cooldown time.Duration) time.Duration {
+	if cooldown <= 0 {
+		return 0
+	}
+	key := cooldownKey{userID: userID, command: command}
+
+	cooldownMu.Lock()
+	defer cooldownMu.Unlock()
+
+	now := time.Now()
+	if last, ok := lastUsed[key]; ok {
+		if wait := cooldown - now.Sub(last); wait > 0 {
+			return wait
+		}
+	}
+	lastUsed[key] = now
+	return 0
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"ai_tg_bot/config"
+)
+
+// requestContext bounds a single OpenAI round trip by the hard deadline.
+// Requests of users under /debug are marked for verbose logging.
+func requestContext(cfg *config.Config, userID int64) (context.Context, context.CancelFunc) {
+	ctx := withUserDebug(context.Background(), userID)
+	if cfg.RequestHardDeadline > 0 {
+		return context.WithTimeout(ctx, cfg.RequestHardDeadline)
+	}
+	return context.WithCancel(ctx)
+}
+
+// holdReply waits until minDelay has passed since received, so that a
+// reply never arrives sooner than REPLY_MIN_DELAY after the message.
+func holdReply(received time.Time, minDelay time.Duration) {
+	if wait := minDelay - time.Since(received); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// notifyAfter runs notify once d has elapsed unless the returned stop
+// function is called first. stop waits for an in-progress notify, so
+// anything sent after stop returns is ordered after the notification.
+func notifyAfter(d time.Duration, notify func()) (stop func()) {
+	if d <= 0 {
+		return func() {}
+	}
+	var mu sync.Mutex
+	stopped := false
+	timer := time.AfterFunc(d, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !stopped {
+			notify()
+		}
+	})
+	return func() {
+		timer.Stop()
+		mu.Lock()
+		stopped = true
+		mu.Unlock()
+	}
+}
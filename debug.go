@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// debugUsers holds the users with verbose request logging enabled through
+// /debug. It lives in memory only and is empty after a restart.
+var debugUsers sync.Map // int64 -> struct{}
+
+func setUserDebug(userID int64, on bool) {
+	if on {
+		debugUsers.Store(userID, struct{}{})
+	} else {
+		debugUsers.Delete(userID)
+	}
+}
+
+type debugUserKey struct{}
+
+// withUserDebug marks ctx for verbose logging if the user has it enabled.
+func withUserDebug(ctx context.Context, userID int64) context.Context {
+	if _, ok := debugUsers.Load(userID); !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, debugUserKey{}, userID)
+}
+
+// debugTransport logs the OpenAI round trips of requests marked with
+// withUserDebug. Message contents are redacted.
+type debugTransport struct {
+	base http.RoundTripper
+}
+
+func (t debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	userID, ok := req.Context().Value(debugUserKey{}).(int64)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			data, _ := io.ReadAll(body)
+			body.Close()
+			log.Printf("[debug user %d] %s %s %s", userID, req.Method, req.URL, redactRequestBody(data))
+		}
+	}
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		log.Printf("[debug user %d] failed after %s: %v", userID, time.Since(start), err)
+		return nil, err
+	}
+	log.Printf("[debug user %d] %s in %s, x-request-id %q", userID, resp.Status, time.Since(start), resp.Header.Get("X-Request-Id"))
+	return resp, nil
+}
+
+// redactRequestBody replaces message contents in a JSON request body with
+// their length, keeping the rest for troubleshooting.
+func redactRequestBody(data []byte) string {
+	var body map[string]interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return "(unparsable body)"
+	}
+	for _, field := range []string{"messages", "input"} {
+		messages, _ := body[field].([]interface{})
+		for _, m := range messages {
+			if msg, ok := m.(map[string]interface{}); ok {
+				switch content := msg["content"].(type) {
+				case string:
+					msg["content"] = redacted(content)
+				case []interface{}:
+					msg["content"] = fmt.Sprintf("[redacted, %d parts]", len(content))
+				}
+			}
+		}
+	}
+	redactedData, _ := json.Marshal(body)
+	return string(redactedData)
+}
+
+func redacted(s string) string {
+	return fmt.Sprintf("[redacted, %d chars]", len([]rune(s)))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ensureUpdateIndexes creates the indexes behind claimUpdate: a unique
+// update_id among {type: "update"} documents, and a TTL on their
+// expires_at. No other documents have expires_at, so the TTL never
+// touches them.
+func ensureUpdateIndexes(collection *mongo.Collection) error {
+	_, err := collection.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "update_id", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"type": "update"}),
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+// claimUpdate records updateID as processed for ttl and reports whether
+// this call was the first to do so. Telegram redelivers updates that were
+// fetched but not confirmed before a crash; a claimed update is skipped
+// after a restart. If MongoDB fails the update is processed anyway. The
+// claim comes before the update is handled, so an update cut short by a
+// crash is lost rather than handled twice.
+func claimUpdate(collection *mongo.Collection, updateID int, ttl time.Duration) bool {
+	doc := bson.M{
+		"type":       "update",
+		"update_id":  updateID,
+		"expires_at": time.Now().Add(ttl),
+	}
+	_, err := collection.InsertOne(context.TODO(), doc)
+	if mongo.IsDuplicateKeyError(err) {
+		log.Printf("Skipping update %d, it was already processed", updateID)
+		return false
+	}
+	if err != nil {
+		log.Printf("Failed to record update %d as processed: %v", updateID, err)
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// denylist holds the compiled DENYLIST patterns. Set at startup.
+var denylist []*regexp.Regexp
+
+// denylistRegexPrefix marks a denylist entry as a regular expression.
+const denylistRegexPrefix = "re:"
+
+// compileDenylist turns denylist entries into case-insensitive patterns.
+// Plain entries match as substrings; entries starting with "re:" are
+// regular expressions.
+func compileDenylist(entries []string) ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		expr := regexp.QuoteMeta(entry)
+		if re, ok := strings.CutPrefix(entry, denylistRegexPrefix); ok {
+			expr = re
+		}
+		pattern, err := regexp.Compile("(?i)" + expr)
+		if err != nil {
+			return nil, fmt.Errorf("denylist entry %q: %w", entry, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// loadDenylistFile reads denylist entries, one per line. Empty lines and
+// lines starting with # are skipped.
+func loadDenylistFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entries = append(entries, scanner.Text())
+	}
+	return entries, scanner.Err()
+}
+
+// allowInput reports whether none of texts matches the denylist, telling
+// the user otherwise. Every path that sends user text to OpenAI calls it,
+// before the daily quota is charged, so blocked messages neither reach
+// OpenAI nor count. A zero chatID (inline queries) skips the reply.
+func allowInput(bot *tgbotapi.BotAPI, userID, chatID int64, lang string, texts ...string) bool {
+	for _, text := range texts {
+		for _, pattern := range denylist {
+			if pattern.MatchString(text) {
+				log.Printf("Blocked message from user %d by the denylist", userID)
+				if chatID != 0 {
+					sendError(bot, chatID, tr(lang, "input_blocked"))
+				}
+				return false
+			}
+		}
+	}
+	return true
+}
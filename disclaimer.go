@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"ai_tg_bot/config"
+)
+
+// showDisclaimer sends the configured disclaimer as a separate message on
+// the first turn of a session. The disclaimer_shown pref remembers it was
+// shown until the session is reset or changed.
+func showDisclaimer(bot *tgbotapi.BotAPI, collection *mongo.Collection, cfg *config.Config, prefs UserPrefs, userID, chatID int64) {
+	if cfg.Disclaimer == "" || prefs.DisclaimerShown {
+		return
+	}
+	if _, err := bot.Send(tgbotapi.NewMessage(chatID, cfg.Disclaimer)); err != nil {
+		log.Printf("Failed to send disclaimer: %v", err)
+		return
+	}
+	if err := setUserPref(collection, userID, "disclaimer_shown", true); err != nil {
+		log.Printf("Failed to save disclaimer state for user %d: %v", userID, err)
+	}
+}
+
+// resetDisclaimer makes the disclaimer show again on the next turn.
+func resetDisclaimer(collection *mongo.Collection, userID int64) {
+	if err := unsetUserPref(collection, userID, "disclaimer_shown"); err != nil {
+		log.Printf("Failed to reset disclaimer state for user %d: %v", userID, err)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"ai_tg_bot/config"
+)
+
+// documentExtensions lists the uploads the bot reads as plain text.
+var documentExtensions = map[string]bool{".txt": true, ".md": true}
+
+const documentInstruction = "The user has uploaded a document. If they asked a question about it, answer it using the document; otherwise summarize the document."
+
+// handleDocument answers a question about an uploaded text document, or
+// summarizes it when the caption is empty. Like /raw it is a one-shot
+// request: neither the document nor the answer is stored in history.
+func handleDocument(bot *tgbotapi.BotAPI, collection *mongo.Collection, cfg *config.Config, requestID int, message *tgbotapi.Message, lang string) {
+	userID, chatID := message.From.ID, message.Chat.ID
+	doc := message.Document
+
+	if !documentExtensions[strings.ToLower(filepath.Ext(doc.FileName))] {
+		bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "doc_unsupported")))
+		return
+	}
+	if doc.FileSize > cfg.DocumentMaxBytes {
+		bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "doc_too_large", cfg.DocumentMaxBytes/1024)))
+		return
+	}
+
+	content, err := downloadDocument(bot, doc.FileID, cfg.DocumentMaxBytes)
+	if err == errDocumentTooLarge {
+		bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "doc_too_large", cfg.DocumentMaxBytes/1024)))
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to download document %q: %v", doc.FileName, err)
+		sendError(bot, chatID, tr(lang, "doc_error"))
+		return
+	}
+	if !allowInput(bot, userID, chatID, lang, message.Caption, content) {
+		return
+	}
+
+	mu := userLock(userID)
+	mu.Lock()
+	allowed := checkDailyQuota(bot, collection, cfg, userID, chatID, lang)
+	mu.Unlock()
+	if !allowed {
+		return
+	}
+
+	prefsID := settingsID(cfg, message)
+	prefs, err := loadPrefs(collection, userID, prefsID)
+	if err != nil {
+		log.Printf("Failed to load user prefs: %v", err)
+	}
+	model := budgetModel(bot, collection, cfg, userID, chatID, lang, requestModel(collection, cfg, prefsID, prefs))
+
+	messages := []OpenAIMessage{{Role: "system", Content: documentInstruction}}
+	if hint, ok := replyLanguageHints[lang]; ok {
+		messages = append(messages, OpenAIMessage{Role: "system", Content: hint})
+	}
+	prompt := fmt.Sprintf("Document %s:\n%s", doc.FileName, content)
+	if question := strings.TrimSpace(message.Caption); question != "" {
+		prompt += "\n\nQuestion: " + question
+	}
+	messages = append(messages, OpenAIMessage{Role: "user", Content: prompt})
+
+	ctx, cancel := requestContext(cfg, userID)
+	defer cancel()
+	stopNotice := notifyAfter(cfg.RequestSoftDeadline, func() {
+		bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "still_working")))
+	})
+	resp, err := withFilterFallback(cfg, model, func(model string) (*OpenAIResponse, error) {
+		model = budgetModel(bot, collection, cfg, userID, 0, lang, model)
+		req := buildRequest(cfg, userID, model, prefs, messages)
+		req.N = nil // only one answer is sent, so /variants doesn't apply
+		return callOpenAI(ctx, req)
+	}, nil)
+	stopNotice()
+	if err != nil {
+		log.Printf("OpenAI request failed: %v", err)
+		recordOpenAIError(userID, requestID, err)
+		sendError(bot, chatID, openAIErrorText(lang, err))
+		return
+	}
+	recordUsage(collection, userID, resp)
+	sendLongMessage(bot, chatID, brandReply(cfg, resp.Choices[0].Message.Content))
+}
+
+var errDocumentTooLarge = errors.New("document exceeds the size limit")
+
+// downloadDocument fetches a file from Telegram as UTF-8 text, reading at
+// most maxBytes.
+func downloadDocument(bot *tgbotapi.BotAPI, fileID string, maxBytes int) (string, error) {
+	url, err := bot.GetFileDirectURL(fileID)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download: unexpected status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(maxBytes)+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxBytes {
+		return "", errDocumentTooLarge
+	}
+	if !utf8.Valid(data) {
+		return "", fmt.Errorf("document is not valid UTF-8")
+	}
+	return string(data), nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Kinds of OpenAI failures; each maps to the catalog key "err_<kind>".
+const (
+	errKindGeneric       = "generic"
+	errKindUnavailable   = "unavailable"
+	errKindTimeout       = "timeout"
+	errKindRateLimit     = "rate_limit"
+	errKindQuota         = "quota"
+	errKindAuth          = "auth"
+	errKindContextLength = "context_length"
+	errKindModelNotFound = "model_not_found"
+	errKindContentFilter = "content_filter"
+	errKindSpendCap      = "spend_cap"
+)
+
+// Errors of the OpenAI client, matched with errors.Is: an *APIError matches
+// the sentinel for its status and code, so callers can pick retry, fallback
+// or user-message behavior without inspecting the response.
+var (
+	ErrRateLimited   = errors.New("openai: rate limited")
+	ErrQuota         = errors.New("openai: quota exceeded")
+	ErrAuth          = errors.New("openai: authentication failed")
+	ErrContextLength = errors.New("openai: context length exceeded")
+	ErrModelNotFound = errors.New("openai: model not found")
+	ErrServer        = errors.New("openai: server error")
+	ErrEmptyResponse = errors.New("openai: empty response")
+
+	// ErrContentFiltered is a reply blocked by the content filter, either
+	// refused outright or cut off with finish reason "content_filter".
+	ErrContentFiltered = errors.New("openai: blocked by the content filter")
+)
+
+// kind returns the sentinel error e matches, or nil.
+func (e *APIError) kind() error {
+	switch {
+	case e.Code == "context_length_exceeded":
+		return ErrContextLength
+	case e.Code == "insufficient_quota":
+		return ErrQuota
+	case e.Code == "model_not_found":
+		return ErrModelNotFound
+	case e.Code == "content_filter", e.Code == "content_policy_violation":
+		return ErrContentFiltered
+	case e.StatusCode == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden:
+		return ErrAuth
+	case e.StatusCode >= 500:
+		return ErrServer
+	}
+	return nil
+}
+
+// Is lets errors.Is match an *APIError against the Err* sentinels.
+func (e *APIError) Is(target error) bool {
+	kind := e.kind()
+	return kind != nil && kind == target
+}
+
+// classifyOpenAIError sorts a failed OpenAI call into one of the error kinds.
+func classifyOpenAIError(err error) string {
+	if errors.Is(err, errCircuitOpen) {
+		return errKindUnavailable
+	}
+	if errors.Is(err, ErrSpendCap) {
+		return errKindSpendCap
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errKindTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errKindTimeout
+	}
+
+	switch {
+	case errors.Is(err, ErrContextLength):
+		return errKindContextLength
+	case errors.Is(err, ErrQuota):
+		return errKindQuota
+	case errors.Is(err, ErrModelNotFound):
+		return errKindModelNotFound
+	case errors.Is(err, ErrContentFiltered):
+		return errKindContentFilter
+	case errors.Is(err, ErrRateLimited):
+		return errKindRateLimit
+	case errors.Is(err, ErrAuth):
+		return errKindAuth
+	case errors.Is(err, ErrServer):
+		return errKindUnavailable
+	}
+	return errKindGeneric
+}
+
+// isEditTargetMissing reports whether a Telegram edit failed because the
+// message is gone, typically deleted by the user while a reply was still
+// being edited into it.
+func isEditTargetMissing(err error) bool {
+	var tgErr *tgbotapi.Error
+	return errors.As(err, &tgErr) && tgErr.Code == http.StatusBadRequest &&
+		strings.Contains(tgErr.Message, "message to edit not found")
+}
+
+// openAIErrorText picks the user-facing message for a failed OpenAI call.
+func openAIErrorText(lang string, err error) string {
+	return tr(lang, "err_"+classifyOpenAIError(err))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ai_tg_bot/config"
+)
+
+// telegramUploadLimit is the largest file a bot may send.
+const telegramUploadLimit = 50 << 20
+
+// exportRecord is one chat message in an export file.
+type exportRecord struct {
+	UserID  int64  `json:"user_id"`
+	Session string `json:"session"`
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// exportBatchSize is how many documents an export fetches from MongoDB
+// at a time.
+const exportBatchSize = 500
+
+// exportAllHistories writes every stored chat message as a JSON array,
+// ordered by user and then chronologically.
+func exportAllHistories(collection *mongo.Collection, w io.Writer) (int, error) {
+	return exportHistories(collection, bson.M{"type": "chat"}, w)
+}
+
+// exportHistories writes the chat messages matching filter as a JSON
+// array, ordered by user and then chronologically, the way history is
+// loaded: insertion order is off for compaction summaries, imported
+// messages and retried saves. Documents are streamed from the cursor
+// batch by batch, so memory use does not grow with the number of
+// messages; the sort may spill to disk, as a whole collection outgrows
+// MongoDB's in-memory sort limit.
+func exportHistories(collection *mongo.Collection, filter bson.M, w io.Writer) (int, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}).
+		SetBatchSize(exportBatchSize).
+		SetAllowDiskUse(true)
+	cursor, err := collection.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(context.TODO())
+
+	if _, err := io.WriteString(w, "[\n"); err != nil {
+		return 0, err
+	}
+	enc := json.NewEncoder(w)
+	count := 0
+	for cursor.Next(context.TODO()) {
+		var msg ChatMessage
+		if err := cursor.Decode(&msg); err != nil {
+			return count, err
+		}
+		if count > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return count, err
+			}
+		}
+		session := msg.Session
+		if session == "" {
+			session = defaultSession
+		}
+		if err := enc.Encode(exportRecord{UserID: msg.UserID, Session: session, Role: msg.Role, Content: msg.Content}); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := cursor.Err(); err != nil {
+		return count, err
+	}
+	_, err = io.WriteString(w, "]\n")
+	return count, err
+}
+
+// exportUser sends the user their stored conversation, all sessions, as a
+// JSON file. The file is assembled in a temporary file as the messages
+// are read and removed after sending.
+func exportUser(bot *tgbotapi.BotAPI, collection *mongo.Collection, userID, chatID int64, lang string) {
+	file, err := os.CreateTemp("", "export_*.json")
+	if err != nil {
+		log.Printf("Failed to create export file: %v", err)
+		sendError(bot, chatID, tr(lang, "export_error"))
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	buf := bufio.NewWriter(file)
+	count, err := exportHistories(collection, bson.M{"user_id": userID, "type": "chat"}, buf)
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err != nil {
+		log.Printf("Failed to export history of user %d: %v", userID, err)
+		sendError(bot, chatID, tr(lang, "export_error"))
+		return
+	}
+	if count == 0 {
+		bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "export_empty")))
+		return
+	}
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err == nil && size > telegramUploadLimit {
+		bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "export_too_large", size>>20)))
+		return
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		log.Printf("Failed to rewind export file: %v", err)
+		sendError(bot, chatID, tr(lang, "export_error"))
+		return
+	}
+
+	name := fmt.Sprintf("chat_history_%s.json", time.Now().UTC().Format("20060102_150405"))
+	doc := tgbotapi.NewDocument(chatID, tgbotapi.FileReader{Name: name, Reader: file})
+	doc.Caption = tr(lang, "export_done", count)
+	if _, err := bot.Send(doc); err != nil {
+		log.Printf("Failed to send export file: %v", err)
+		sendError(bot, chatID, tr(lang, "export_error"))
+	}
+}
+
+// exportAll dumps all conversations to a file and sends it to the admin.
+// With EXPORT_DIR set the file is kept there and only its path is reported;
+// otherwise it goes to a temporary file that is removed after sending.
+func exportAll(bot *tgbotapi.BotAPI, collection *mongo.Collection, cfg *config.Config, chatID int64, lang string) {
+	bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "export_all_started")))
+
+	name := fmt.Sprintf("chat_history_%s.json", time.Now().UTC().Format("20060102_150405"))
+	var file *os.File
+	var err error
+	if cfg.ExportDir != "" {
+		file, err = os.Create(filepath.Join(cfg.ExportDir, name))
+	} else {
+		file, err = os.CreateTemp("", "export_*.json")
+	}
+	if err != nil {
+		log.Printf("Failed to create export file: %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "export_all_error")))
+		return
+	}
+	path := file.Name()
+	if cfg.ExportDir == "" {
+		defer os.Remove(path)
+	}
+
+	buf := bufio.NewWriter(file)
+	count, err := exportAllHistories(collection, buf)
+	if err == nil {
+		err = buf.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Printf("Failed to export histories: %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "export_all_error")))
+		return
+	}
+	log.Printf("Exported %d messages to %s", count, path)
+
+	if cfg.ExportDir != "" {
+		bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "export_all_saved", count, path)))
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Printf("Failed to stat export file: %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "export_all_error")))
+		return
+	}
+	if info.Size() > telegramUploadLimit {
+		bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "export_all_too_large", info.Size()>>20)))
+		return
+	}
+
+	export, err := os.Open(path)
+	if err != nil {
+		log.Printf("Failed to reopen export file: %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "export_all_error")))
+		return
+	}
+	defer export.Close()
+
+	doc := tgbotapi.NewDocument(chatID, tgbotapi.FileReader{Name: name, Reader: export})
+	doc.Caption = tr(lang, "export_all_done", count)
+	if _, err := bot.Send(doc); err != nil {
+		log.Printf("Failed to send export file: %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "export_all_error")))
+	}
+}
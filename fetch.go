@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf16"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	fetchUserAgent = "ai_tg_bot"
+	fetchTimeout   = 10 * time.Second
+	fetchMaxBytes  = 1 << 20 // read at most 1 MiB of a page
+	fetchMaxURLs   = 3       // pages fetched per message
+	fetchMaxHops   = 5       // redirects followed per fetch
+)
+
+// fetchClient fetches the pages users link to. Since the URLs come from
+// users, its dialer refuses internal addresses once the host has been
+// resolved, for the first request and every redirect alike, so links
+// can't reach the bot's own network or cloud metadata endpoints. No
+// proxy is used: it would resolve hosts past the check.
+var fetchClient = &http.Client{
+	Timeout: fetchTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: fetchTimeout,
+			Control: refuseInternalAddress,
+		}).DialContext,
+		TLSHandshakeTimeout:   fetchTimeout,
+		ResponseHeaderTimeout: fetchTimeout,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= fetchMaxHops {
+			return fmt.Errorf("stopped after %d redirects", fetchMaxHops)
+		}
+		return nil
+	},
+}
+
+// internalPrefixes are the non-global ranges netip has no predicate for.
+var internalPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved, and broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64 of IPv4 addresses
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local-use NAT64
+	netip.MustParsePrefix("100::/64"),        // discard
+	netip.MustParsePrefix("2001::/23"),       // IETF protocol assignments
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4
+	netip.MustParsePrefix("fec0::/10"),       // site-local
+}
+
+// refuseInternalAddress is a net.Dialer Control hook that rejects
+// loopback, private, link-local, unspecified, multicast and the other
+// non-global addresses, IPv4 ones also in their IPv4-mapped IPv6 form.
+func refuseInternalAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() || ip.IsInterfaceLocalMulticast() {
+		return fmt.Errorf("refusing to fetch from internal address %s", ip)
+	}
+	for _, prefix := range internalPrefixes {
+		if prefix.Contains(ip) {
+			return fmt.Errorf("refusing to fetch from internal address %s", ip)
+		}
+	}
+	return nil
+}
+
+var (
+	errRobotsDisallowed = errors.New("fetch disallowed by robots.txt")
+
+	htmlHiddenRe = regexp.MustCompile(`(?is)<(script|style|noscript|head)\b.*?</(script|style|noscript|head)>`)
+	htmlTagRe    = regexp.MustCompile(`(?s)<[^>]*>`)
+	spaceRe      = regexp.MustCompile(`[ \t\r\f\v]+`)
+	blankLinesRe = regexp.MustCompile(`\n\s*\n+`)
+)
+
+// messageURLs returns the links marked up in the message entities, both
+// plain URLs and text links, without duplicates.
+func messageURLs(message *tgbotapi.Message) []string {
+	text, entities := message.Text, message.Entities
+	if text == "" {
+		text, entities = message.Caption, message.CaptionEntities
+	}
+	units := utf16.Encode([]rune(text))
+
+	var urls []string
+	seen := make(map[string]bool)
+	for _, e := range entities {
+		var link string
+		switch e.Type {
+		case "url":
+			if e.Offset < 0 || e.Offset+e.Length > len(units) {
+				continue
+			}
+			link = string(utf16.Decode(units[e.Offset : e.Offset+e.Length]))
+			if !strings.Contains(link, "://") {
+				link = "http://" + link
+			}
+		case "text_link":
+			link = e.URL
+		default:
+			continue
+		}
+		if !seen[link] {
+			seen[link] = true
+			urls = append(urls, link)
+		}
+	}
+	return urls
+}
+
+// fetchURLContent downloads a web page and returns its visible text. Pages
+// disallowed by the site's robots.txt are not fetched.
+func fetchURLContent(ctx context.Context, rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	allowed, err := robotsAllowed(ctx, u)
+	if err != nil {
+		return "", err
+	}
+	if !allowed {
+		return "", errRobotsDisallowed
+	}
+
+	resp, err := httpGet(ctx, u.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetch %s: unexpected status %s", u, resp.Status)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if contentType != "" && !strings.HasPrefix(contentType, "text/") {
+		return "", fmt.Errorf("fetch %s: unsupported content type %q", u, contentType)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, fetchMaxBytes))
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(contentType, "text/html") || contentType == "" {
+		return htmlToText(string(body)), nil
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+func httpGet(ctx context.Context, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", fetchUserAgent)
+	return fetchClient.Do(req)
+}
+
+// robotsAllowed checks the path against the "User-agent: *" rules of the
+// site's robots.txt. The longest matching rule wins, and a missing
+// robots.txt allows everything.
+func robotsAllowed(ctx context.Context, u *url.URL) (bool, error) {
+	robotsURL := url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/robots.txt"}
+	resp, err := httpGet(ctx, robotsURL.String())
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return true, nil
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	allowed, matched := true, -1
+	inGroup, groupHasRules := false, false
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, fetchMaxBytes))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		switch key {
+		case "user-agent":
+			if groupHasRules {
+				inGroup, groupHasRules = false, false
+			}
+			if value == "*" {
+				inGroup = true
+			}
+		case "allow", "disallow":
+			groupHasRules = true
+			if !inGroup || value == "" || !strings.HasPrefix(path, value) {
+				continue
+			}
+			if len(value) > matched {
+				matched = len(value)
+				allowed = key == "allow"
+			}
+		}
+	}
+	return allowed, scanner.Err()
+}
+
+// htmlToText strips markup from a page, keeping a rough line structure.
+func htmlToText(page string) string {
+	page = htmlHiddenRe.ReplaceAllString(page, " ")
+	page = htmlTagRe.ReplaceAllString(page, "\n")
+	page = html.UnescapeString(page)
+	page = spaceRe.ReplaceAllString(page, " ")
+	page = blankLinesRe.ReplaceAllString(page, "\n")
+	return strings.TrimSpace(page)
+}
+
+// fetchLinkedPages fetches the linked pages and formats them as context
+// for the model. Pages that fail to load are skipped.
+func fetchLinkedPages(ctx context.Context, urls []string, maxChars int) []string {
+	var pages []string
+	for i, link := range urls {
+		if i == fetchMaxURLs {
+			break
+		}
+		content, err := fetchURLContent(ctx, link)
+		if err != nil {
+			log.Printf("Failed to fetch %s: %v", link, err)
+			continue
+		}
+		if content == "" {
+			continue
+		}
+		if runes := []rune(content); len(runes) > maxChars {
+			content = string(runes[:maxChars]) + "..."
+		}
+		pages = append(pages, fmt.Sprintf("Here is the content of the linked page %s:\n%s", link, content))
+	}
+	return pages
+}
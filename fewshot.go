@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// fewShotMessages are example turns injected after the system hints on
+// every request. They are never stored in user history.
+var fewShotMessages []OpenAIMessage
+
+// loadFewShotMessages reads a JSON array of {"role", "content"} objects.
+// Only "user" and "assistant" roles are accepted.
+func loadFewShotMessages(path string) ([]OpenAIMessage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var messages []OpenAIMessage
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i, msg := range messages {
+		if msg.Role != "user" && msg.Role != "assistant" {
+			return nil, fmt.Errorf("%s: message %d has unsupported role %q", path, i, msg.Role)
+		}
+		if msg.Content == "" {
+			return nil, fmt.Errorf("%s: message %d has empty content", path, i)
+		}
+	}
+	return messages, nil
+}
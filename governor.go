@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Telegram's flood limits: about 30 messages per second overall and 20
+// per minute in a single group.
+const (
+	globalSendInterval = time.Second / 30
+	groupSendLimit     = 20
+	groupSendWindow    = time.Minute
+)
+
+// sendGovernor paces the bot's outgoing messages under Telegram's flood
+// limits, so that sends wait their turn instead of failing with 429. It
+// wraps the bot's HTTP client, so every send, edit and broadcast goes
+// through it. Other API calls, getUpdates above all, pass unpaced.
+//
+// If Telegram still answers 429, the chat is paused for the retry_after
+// it asks for and the send is retried once. Sends whose chat can't be told
+// (multipart uploads) pause nothing: pausing every chat for one of them
+// would hold up the whole bot.
+//
+// Pacing sleeps in the sending goroutine, so the update loop never sends
+// itself; messages are handled on per-chat goroutines (see chatQueues).
+type sendGovernor struct {
+	client tgbotapi.HTTPClient
+
+	mu         sync.Mutex
+	globalNext time.Time
+	groupSends map[int64][]time.Time // reserved send times within the window
+	pausedTill map[int64]time.Time
+}
+
+func newSendGovernor(client tgbotapi.HTTPClient) *sendGovernor {
+	return &sendGovernor{
+		client:     client,
+		groupSends: map[int64][]time.Time{},
+		pausedTill: map[int64]time.Time{},
+	}
+}
+
+func isPacedMethod(method string) bool {
+	switch {
+	case method == "sendChatAction":
+		return false
+	case strings.HasPrefix(method, "send"), strings.HasPrefix(method, "edit"),
+		method == "copyMessage", method == "forwardMessage":
+		return true
+	}
+	return false
+}
+
+func (g *sendGovernor) Do(req *http.Request) (*http.Response, error) {
+	if !isPacedMethod(path.Base(req.URL.Path)) {
+		return g.client.Do(req)
+	}
+	chatID := requestChatID(req)
+
+	for attempt := 0; ; attempt++ {
+		if err := g.wait(req, chatID); err != nil {
+			return nil, err
+		}
+		resp, err := g.client.Do(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+			return resp, err
+		}
+
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		retryAfter := retryAfterOf(body)
+		metricFloodWaits.Add(1)
+		if chatID == 0 {
+			log.Printf("Telegram flood control for an upload, retry after %s", retryAfter)
+			return resp, nil
+		}
+		log.Printf("Telegram flood control for chat %d, pausing %s", chatID, retryAfter)
+		g.pause(chatID, retryAfter)
+
+		if attempt > 0 || req.GetBody == nil {
+			return resp, nil
+		}
+		if req.Body, err = req.GetBody(); err != nil {
+			return resp, nil
+		}
+	}
+}
+
+// wait blocks until chatID may be sent to, or the request is canceled.
+func (g *sendGovernor) wait(req *http.Request, chatID int64) error {
+	delay := g.reserve(chatID)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+// reserve books the earliest send slot for chatID and returns how long to
+// wait for it.
+func (g *sendGovernor) reserve(chatID int64) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	at := now
+	if till := g.pausedTill[chatID]; till.After(at) {
+		at = till
+	}
+	if g.globalNext.After(at) {
+		at = g.globalNext
+	}
+
+	// Group chats have negative IDs.
+	if chatID < 0 {
+		sends := g.groupSends[chatID]
+		for len(sends) > 0 && !sends[0].Add(groupSendWindow).After(now) {
+			sends = sends[1:]
+		}
+		if len(sends) >= groupSendLimit {
+			if free := sends[len(sends)-groupSendLimit].Add(groupSendWindow); free.After(at) {
+				at = free
+			}
+		}
+		g.groupSends[chatID] = append(sends, at)
+	}
+	g.globalNext = at.Add(globalSendInterval)
+
+	for id, till := range g.pausedTill {
+		if !till.After(now) {
+			delete(g.pausedTill, id)
+		}
+	}
+	for id, sends := range g.groupSends {
+		if len(sends) == 0 || !sends[len(sends)-1].Add(groupSendWindow).After(now) {
+			delete(g.groupSends, id)
+		}
+	}
+	return at.Sub(now)
+}
+
+func (g *sendGovernor) pause(chatID int64, d time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	till := time.Now().Add(d)
+	if till.After(g.pausedTill[chatID]) {
+		g.pausedTill[chatID] = till
+	}
+}
+
+// requestChatID reads chat_id from a form-encoded Bot API request, leaving
+// the body intact. It returns 0 for multipart uploads and requests without
+// a numeric chat_id, such as sends to @channel usernames.
+func requestChatID(req *http.Request) int64 {
+	if req.GetBody == nil || !strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return 0
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return 0
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return 0
+	}
+	values, err := url.ParseQuery(string(data))
+	if err != nil {
+		return 0
+	}
+	chatID, _ := strconv.ParseInt(values.Get("chat_id"), 10, 64)
+	return chatID
+}
+
+// retryAfterOf extracts parameters.retry_after from a 429 response body,
+// defaulting to a second.
+func retryAfterOf(body []byte) time.Duration {
+	var resp struct {
+		Parameters struct {
+			RetryAfter int `json:"retry_after"`
+		} `json:"parameters"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || resp.Parameters.RetryAfter <= 0 {
+		return time.Second
+	}
+	return time.Duration(resp.Parameters.RetryAfter) * time.Second
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"ai_tg_bot/config"
+)
+
+func isGroupChat(chat *tgbotapi.Chat) bool {
+	return chat.IsGroup() || chat.IsSuperGroup()
+}
+
+// groupContextHint tells the model that message comes from a group chat,
+// per GROUP_CONTEXT: "title" names the group, "sender" also names the
+// sender by first name only. Other values, and private chats, add nothing.
+func groupContextHint(cfg *config.Config, message *tgbotapi.Message) string {
+	if !isGroupChat(message.Chat) {
+		return ""
+	}
+	switch cfg.GroupContext {
+	case "title":
+		return fmt.Sprintf("This is a group chat named %q with several participants.", message.Chat.Title)
+	case "sender":
+		return fmt.Sprintf("This is a group chat named %q with several participants. The latest message is from %s.", message.Chat.Title, message.From.FirstName)
+	}
+	return ""
+}
+
+// senderName is the name group messages are attributed to with
+// GROUP_SENDER_NAMES on: the sender's first name. It is empty in private
+// chats and with the setting off.
+func senderName(cfg *config.Config, message *tgbotapi.Message) string {
+	if !cfg.GroupSenderNames || !isGroupChat(message.Chat) {
+		return ""
+	}
+	return message.From.FirstName
+}
+
+// withSender prefixes a user message with its sender's name, as in
+// "Alice: hello", so the model can tell participants apart and address
+// them. An empty name leaves text as is.
+func withSender(name, text string) string {
+	if name == "" {
+		return text
+	}
+	return name + ": " + text
+}
+
+// settingsID is the ID the model and prefs that apply to message are
+// stored under: the chat's in a group with GROUP_SETTINGS on, the
+// sender's otherwise. Group chat IDs are negative, so they never clash
+// with user IDs.
+func settingsID(cfg *config.Config, message *tgbotapi.Message) int64 {
+	if cfg.GroupSettings && isGroupChat(message.Chat) {
+		return message.Chat.ID
+	}
+	return message.From.ID
+}
+
+// loadPrefs returns the prefs stored under prefsID. When those are a
+// group's, the fields that only make sense per user, the active session
+// and its last activity, the disclaimer, private mode and the tier, still
+// come from the user's own prefs.
+func loadPrefs(collection *mongo.Collection, userID, prefsID int64) (UserPrefs, error) {
+	prefs, err := getUserPrefs(collection, userID)
+	if err != nil || prefsID == userID {
+		return prefs, err
+	}
+	group, err := getUserPrefs(collection, prefsID)
+	group.ActiveSession = prefs.ActiveSession
+	group.LastActive = prefs.LastActive
+	group.DisclaimerShown = prefs.DisclaimerShown
+	group.Private = prefs.Private
+	group.Tier = prefs.Tier
+	return group, err
+}
+
+// changesSettings reports whether a command with args changes the model
+// or prefs, which in a group with GROUP_SETTINGS on only its admins may
+// do. Commands without arguments only show the current value or usage.
+func changesSettings(command, args string) bool {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return false
+	}
+	switch command {
+	case "model":
+		return fields[0] != "info" && fields[0] != "compare"
+	case "preset":
+		return fields[0] == "use"
+	case "length", "json", "seed", "topp", "variants", "stateless", "system", "footer", "verbose", "lang":
+		return true
+	}
+	return false
+}
+
+// isChatAdmin reports whether userID is an administrator or the creator
+// of chatID.
+func isChatAdmin(bot *tgbotapi.BotAPI, chatID, userID int64) (bool, error) {
+	member, err := bot.GetChatMember(tgbotapi.GetChatMemberConfig{
+		ChatConfigWithUser: tgbotapi.ChatConfigWithUser{ChatID: chatID, UserID: userID},
+	})
+	if err != nil {
+		return false, err
+	}
+	return member.IsAdministrator() || member.IsCreator(), nil
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"unicode"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// defaultLang is used when nothing better is known about a user.
+const defaultLang = "ru"
+
+// catalog holds the bot's fixed strings per language. Values may contain
+// fmt verbs filled in by tr.
+var catalog = map[string]map[string]string{
+	"ru": {
+		"start":                    "Привет! Отправь сообщение, и я отвечу с помощью OpenAI. Можно выбрать модель командой /model <имя_модели> (например, gpt-3.5-turbo). По умолчанию используется gpt-3.5-turbo. Список команд: /help",
+		"help_header":              "Доступные команды:",
+		"admin_only":               "Команда доступна только администраторам",
+		"unknown_command":          "Неизвестная команда /%s, список команд: /help",
+		"group_admin_only":         "В этой группе настройки бота меняют только её администраторы",
+		"group_admin_error":        "Не удалось проверить права администратора",
+		"prefs_error":              "Ошибка при загрузке настроек",
+		"pref_error":               "Ошибка при сохранении настройки",
+		"db_error":                 "Ошибка при обращении к базе данных",
+		"still_working":            "Всё ещё готовлю ответ, подождите немного...",
+		"request_in_progress":      "Предыдущий запрос ещё обрабатывается, подождите ответа",
+		"budget_downgrade_daily":   "Дневной бюджет бота исчерпан, до конца дня (UTC) отвечает модель %s",
+		"budget_downgrade_monthly": "Месячный бюджет бота исчерпан, до конца месяца (UTC) отвечает модель %s",
+		"cooldown":                 "Подождите %s перед повторным использованием /%s",
+		"internal_error":           "Произошла внутренняя ошибка, попробуйте ещё раз",
+		"quota_reached":            "Дневной лимит в %d сообщений исчерпан. Он обновится через %s (в 00:00 UTC)",
+		"input_blocked":            "Извините, я не могу ответить на это сообщение",
+
+		"err_generic":         "Ошибка при обращении к OpenAI API",
+		"err_unavailable":     "Сервис OpenAI временно недоступен, попробуйте позже",
+		"err_timeout":         "Извините, OpenAI не ответил вовремя. Попробуйте ещё раз",
+		"err_rate_limit":      "Слишком много запросов к OpenAI. Подождите минуту и повторите",
+		"err_quota":           "У бота закончилась квота OpenAI. Сообщите администратору",
+		"err_auth":            "Бот не смог авторизоваться в OpenAI. Сообщите администратору",
+		"err_context_length":  "Переписка слишком длинная для модели. Очистите историю командой /reset",
+		"err_model_not_found": "Выбранная модель недоступна. Выберите другую командой /model",
+		"err_content_filter":  "Ответ заблокирован фильтром содержимого. Попробуйте переформулировать сообщение",
+		"err_spend_cap":       "Бот временно не отвечает: исчерпан лимит расходов. Попробуйте позже",
+		"history_truncated":   "История переписки не помещалась в контекст модели, самые старые сообщения были удалены",
+
+		"model_usage":       "Пожалуйста, укажите имя модели после команды /model или /model default, чтобы вернуть модель по умолчанию",
+		"compare_usage":     "Использование: /model compare <модель A> <модель B> <запрос>",
+		"compare_header":    "▸ %s",
+		"model_error":       "Ошибка при сохранении модели",
+		"model_set":         "Модель установлена на %s",
+		"model_not_in_tier": "Модель %s недоступна на вашем тарифе (%s)",
+		"model_default":     "Модель сброшена, используется модель по умолчанию: %s",
+		"model_info":        "Модель: %s\nКонтекстное окно: %d токенов\nЦена: $%.2f / $%.2f за 1M токенов (вход / выход)\nИзображения: %s\nВызов функций: %s\nJSON-режим: %s",
+		"model_unknown":     "Модель %s отсутствует в справочнике, сведений о ней нет",
+		"yes":               "да",
+		"no":                "нет",
+
+		"raw_usage":   "Пожалуйста, укажите запрос после команды /raw",
+		"think_usage": "Использование: /think <вопрос> — ответит модель с рассуждением, в историю вопрос не попадёт",
+
+		"doc_unsupported": "Поддерживаются только текстовые документы .txt и .md",
+		"doc_too_large":   "Документ слишком большой, максимум %d КБ",
+		"doc_error":       "Не удалось прочитать документ",
+
+		"length_usage":   "Использование: /length short|medium|long|default",
+		"length_invalid": "Допустимые значения: short, medium, long, default",
+		"length_set":     "Длина ответов установлена: %s",
+
+		"json_usage": "Использование: /json on|off",
+		"json_on":    "JSON-режим включён: ответы будут возвращаться в виде JSON-объекта",
+		"json_off":   "JSON-режим выключен",
+
+		"seed_usage":            "Использование: /seed <число>|off",
+		"seed_invalid":          "Seed должен быть целым числом",
+		"seed_set":              "Seed установлен на %d",
+		"seed_off":              "Seed сброшен",
+		"topp_usage":            "Использование: /topp <значение от 0 до 1>|off",
+		"topp_current":          "Текущее значение top_p: %g",
+		"topp_invalid":          "top_p должен быть числом от 0 до 1",
+		"topp_set":              "top_p установлен на %g",
+		"topp_off":              "top_p сброшен",
+		"topp_with_temperature": "Обратите внимание: бот также задаёт temperature, а менять оба параметра одновременно не рекомендуется",
+		"params_header":         "Параметры запроса:",
+		"params_not_set":        "не задано (по умолчанию модели)",
+		"params_model_override": "(из MODEL_DEFAULTS)",
+		"params_random":         "случайное от %g до %g",
+		"params_auto":           "подбирается под оставшийся контекст",
+		"params_system_prompt":  "системный промпт",
+		"params_prompt_custom":  "ваш (/system)",
+		"params_prompt_default": "по умолчанию",
+		"params_prompt_none":    "нет",
+
+		"broadcast_usage": "Пожалуйста, укажите текст после команды /broadcast",
+		"broadcast_error": "Ошибка при получении списка пользователей",
+		"broadcast_done":  "Рассылка завершена: доставлено %d, ошибок %d",
+
+		"debug_usage":        "Использование: /debug <user_id> on|off",
+		"debug_on":           "Подробное логирование запросов пользователя %d включено",
+		"debug_off":          "Подробное логирование запросов пользователя %d выключено",
+		"maintenance_usage":  "Использование: /maintenance on|off",
+		"maintenance_active": "Режим обслуживания включён",
+		"maintenance_on":     "Режим обслуживания включён: пользователи получают уведомление, запросы к OpenAI не выполняются",
+		"maintenance_off":    "Режим обслуживания выключен",
+		"maintenance_notice": "Бот на техническом обслуживании. Пожалуйста, попробуйте позже",
+		"lasterror_usage":    "Использование: /lasterror <user_id>",
+		"lasterror_none":     "Для пользователя %d ошибок не записано",
+		"spendcap_usage":     "Использование: /spendcap или /spendcap reset",
+		"spendcap_disabled":  "Лимит расходов не задан (SPEND_CAP)",
+		"spendcap_status":    "Потрачено $%.2f из $%.2f с %s",
+		"spendcap_reached":   "Лимит исчерпан, запросы к OpenAI остановлены",
+		"version":            "Версия: %s\nGo: %s\nРаботает: %s (с %s)",
+		"tier_usage":         "Использование: /tier <user_id> <тариф>",
+		"tier_unknown":       "Неизвестный тариф %q",
+		"tier_set":           "Пользователь %d переведён на тариф %s",
+		"lasterror":          "Последняя ошибка пользователя %d\nТип: %s\nСообщение: %s\nВремя: %s\nЗапрос: req %d",
+
+		"export_all_started":   "Выгружаю все переписки. Если база большая, это может занять время и файл получится объёмным",
+		"export_error":         "Ошибка при выгрузке переписки",
+		"export_empty":         "Сохранённых сообщений нет",
+		"export_done":          "Ваша переписка, сообщений: %d",
+		"export_too_large":     "Файл выгрузки (%d МБ) превышает лимит Telegram в 50 МБ",
+		"import_usage":         "Отправьте файл выгрузки .json с подписью /import, чтобы восстановить переписку в текущую сессию",
+		"import_too_large":     "Файл слишком большой, максимум %d КБ",
+		"import_invalid":       "Это не похоже на файл выгрузки: %v",
+		"import_empty":         "В файле нет сообщений",
+		"import_stateless":     "История сейчас не сохраняется, импортировать некуда",
+		"import_error":         "Ошибка при импорте переписки",
+		"import_done":          "Импортировано сообщений: %d, сессия %s",
+		"export_all_error":     "Ошибка при выгрузке переписок",
+		"export_all_done":      "Выгружено сообщений: %d",
+		"export_all_saved":     "Выгружено сообщений: %d. Файл сохранён: %s",
+		"export_all_too_large": "Файл выгрузки (%d МБ) превышает лимит Telegram в 50 МБ. Задайте EXPORT_DIR, чтобы сохранять выгрузку на сервере",
+
+		"reset_error":      "Ошибка при очистке истории",
+		"reset_done":       "История переписки очищена",
+		"session_ended":    "Разговор завершён, история очищена. Напишите, когда захотите начать заново",
+		"reset_stateless":  "История не ведётся (режим без истории), сохранённые ранее сообщения удалены",
+		"inactivity_reset": "Давно не виделись — начинаю разговор заново",
+
+		"count":      "Сообщений в сессии %s: %d (ваших: %d, ответов: %d)",
+		"again_none": "В этой сессии ещё нет ответов",
+
+		"stateless_usage":  "Использование: /stateless on|off",
+		"stateless_global": "Режим без истории включён для всех пользователей администратором",
+		"stateless_on":     "Режим без истории включён: каждое сообщение обрабатывается независимо",
+		"stateless_off":    "Режим без истории выключен, переписка снова сохраняется",
+		"private_usage":    "Использование: /private on|off",
+		"private_on":       "Приватный режим включён: ваши сообщения и ответы больше не сохраняются, сохранённая история удалена",
+		"private_off":      "Приватный режим выключен, переписка снова сохраняется",
+
+		"footer_usage": "Использование: /footer on|off",
+		"footer_on":    "Под ответами будут показаны модель и примерная стоимость",
+		"footer_off":   "Модель и стоимость под ответами больше не показываются",
+		"footer_model": "— %s",
+		"footer_cost":  "— %s · ≈$%.4f",
+
+		"verbose_usage": "Использование: /verbose on|off",
+		"verbose_on":    "Под ответами будут показаны токены, время ответа и причина завершения",
+		"verbose_off":   "Диагностика под ответами отключена",
+
+		"variants_usage":       "Использование: /variants <1-%d>|off",
+		"variants_set":         "Число вариантов ответа на каждое сообщение: %d",
+		"variants_off":         "На каждое сообщение снова приходит один ответ",
+		"variants_unsupported": "Этот бот не поддерживает несколько вариантов ответа",
+		"variant_header":       "Вариант %d",
+		"pick_prompt":          "Какой вариант сохранить в истории? Сейчас сохранён первый.",
+		"pick_usage":           "Использование: /pick <номер варианта>",
+		"pick_done":            "В истории сохранён вариант %d",
+		"pick_expired":         "Выбирать больше не из чего: варианты устарели или уже выбраны",
+		"pick_invalid":         "Нет варианта с таким номером",
+		"pick_error":           "Не удалось сохранить выбранный вариант",
+
+		"session_usage":       "Использование: /session new|switch|delete <имя> или /session list",
+		"session_list_error":  "Ошибка при загрузке списка сессий",
+		"session_list":        "Сессии:",
+		"session_name_needed": "Пожалуйста, укажите имя сессии: /session %s <имя>",
+		"session_name_long":   "Имя сессии не должно превышать %d символов",
+		"session_exists":      "Сессия %s уже существует",
+		"session_not_found":   "Сессия %s не найдена",
+		"session_create_err":  "Ошибка при создании сессии",
+		"session_switch_err":  "Ошибка при переключении сессии",
+		"session_delete_err":  "Ошибка при удалении сессии",
+		"session_created":     "Создана и активирована сессия %s",
+		"session_switched":    "Активная сессия: %s",
+		"session_no_default":  "Сессию по умолчанию удалить нельзя",
+		"session_deleted":     "Сессия %s удалена",
+		"session_deleted_to":  "Сессия %s удалена, активна сессия %s",
+		"session_unknown":     "Неизвестная подкоманда. Доступно: new, switch, list, delete",
+		"session_limit":       "Достигнут лимит сессий (%d). Удалите ненужную командой /session delete <имя>",
+		"session_evicted":     "Достигнут лимит сессий, удалена давно не использовавшаяся сессия %s",
+
+		"lang_usage": "Использование: /lang ru|en|auto",
+		"lang_set":   "Язык интерфейса: русский",
+		"lang_auto":  "Язык будет определяться автоматически по вашим сообщениям",
+
+		"system_usage":    "Использование: /system <текст> задаёт системный промпт, /system clear сбрасывает его",
+		"system_current":  "Текущий системный промпт:\n%s",
+		"system_set":      "Системный промпт сохранён",
+		"system_cleared":  "Системный промпт сброшен",
+		"system_too_long": "Системный промпт не должен превышать %d символов",
+
+		"preset_usage":       "Использование: /preset save|use|delete <имя> или /preset list",
+		"preset_name_needed": "Пожалуйста, укажите имя пресета: /preset %s <имя>",
+		"preset_name_long":   "Имя пресета не должно превышать %d символов",
+		"preset_no_prompt":   "Нечего сохранять: задайте системный промпт командой /system или укажите текст после имени пресета",
+		"preset_saved":       "Пресет %s сохранён",
+		"preset_used":        "Пресет %s применён как системный промпт",
+		"preset_deleted":     "Пресет %s удалён",
+		"preset_not_found":   "Пресет %s не найден",
+		"preset_none":        "Сохранённых пресетов нет",
+		"preset_list":        "Пресеты:",
+
+		"cmd_start":       "Начать работу с ботом",
+		"cmd_help":        "Список команд",
+		"cmd_model":       "Выбрать модель OpenAI, /model info, /model default или /model compare",
+		"cmd_raw":         "Разовый запрос без истории",
+		"cmd_length":      "Длина ответов: short, medium, long",
+		"cmd_json":        "JSON-режим ответов: on или off",
+		"cmd_seed":        "Seed для воспроизводимых ответов",
+		"cmd_topp":        "top_p для выборки: от 0 до 1 или off",
+		"cmd_params":      "Показать параметры запросов",
+		"cmd_reset":       "Очистить историю переписки",
+		"cmd_stateless":   "Режим без истории: on или off",
+		"cmd_again":       "Повторить последний ответ",
+		"cmd_private":     "Приватный режим: on или off",
+		"cmd_session":     "Управление сессиями переписки",
+		"cmd_lang":        "Язык интерфейса: ru, en или auto",
+		"cmd_broadcast":   "Рассылка всем пользователям",
+		"cmd_export_all":  "Выгрузить все переписки",
+		"cmd_export":      "Выгрузить свою переписку",
+		"cmd_system":      "Системный промпт",
+		"cmd_preset":      "Библиотека системных промптов",
+		"cmd_footer":      "Модель и стоимость под ответами: on или off",
+		"cmd_count":       "Сколько сообщений хранится в сессии",
+		"cmd_debug":       "Подробные логи для пользователя",
+		"cmd_maintenance": "Режим обслуживания: on или off",
+		"cmd_variants":    "Несколько вариантов ответа: 1-4 или off",
+		"cmd_pick":        "Выбрать вариант ответа для истории",
+		"cmd_think":       "Спросить модель с рассуждением",
+		"cmd_lasterror":   "Последняя ошибка пользователя",
+		"cmd_tier":        "Назначить тариф пользователю",
+		"cmd_verbose":     "Диагностика под ответами: on или off",
+		"cmd_version":     "Версия и время работы бота",
+		"cmd_import":      "Восстановить переписку из файла выгрузки",
+		"cmd_spendcap":    "Лимит расходов: состояние или reset",
+	},
+	"en": {
+		"start":                    "Hi! Send me a message and I'll answer using OpenAI. You can pick a model with /model <model_name> (e.g. gpt-3.5-turbo). gpt-3.5-turbo is used by default. List of commands: /help",
+		"help_header":              "Available commands:",
+		"admin_only":               "This command is available to administrators only",
+		"unknown_command":          "Unknown command /%s, try /help",
+		"group_admin_only":         "Only the group's administrators can change the bot's settings here",
+		"group_admin_error":        "Failed to check administrator rights",
+		"prefs_error":              "Failed to load settings",
+		"pref_error":               "Failed to save the setting",
+		"db_error":                 "Database error",
+		"still_working":            "Still working on the answer, please wait...",
+		"request_in_progress":      "Your previous request is still being processed, please wait for the answer",
+		"budget_downgrade_daily":   "The bot's daily budget is used up, %s answers until the end of the day (UTC)",
+		"budget_downgrade_monthly": "The bot's monthly budget is used up, %s answers until the end of the month (UTC)",
+		"cooldown":                 "Please wait %s before using /%s again",
+		"internal_error":           "An internal error occurred, please try again",
+		"quota_reached":            "You have reached the daily limit of %d messages. It resets in %s (at 00:00 UTC)",
+		"input_blocked":            "Sorry, I can't respond to that message",
+
+		"err_generic":         "OpenAI API request failed",
+		"err_unavailable":     "OpenAI is temporarily unavailable, please try again later",
+		"err_timeout":         "Sorry, OpenAI did not answer in time. Please try again",
+		"err_rate_limit":      "Too many requests to OpenAI. Please wait a minute and retry",
+		"err_quota":           "The bot has run out of OpenAI quota. Please tell the administrator",
+		"err_auth":            "The bot could not authenticate with OpenAI. Please tell the administrator",
+		"err_context_length":  "The conversation is too long for the model. Clear it with /reset",
+		"err_model_not_found": "The selected model is not available. Choose another one with /model",
+		"err_content_filter":  "The reply was blocked by the content filter. Try rephrasing your message",
+		"err_spend_cap":       "The bot is paused: its spending limit has been reached. Please try again later",
+		"history_truncated":   "The conversation no longer fit into the model's context, the oldest messages were removed",
+
+		"model_usage":       "Please specify a model name after /model, or /model default to go back to the default model",
+		"compare_usage":     "Usage: /model compare <model A> <model B> <prompt>",
+		"compare_header":    "▸ %s",
+		"model_error":       "Failed to save the model",
+		"model_set":         "Model set to %s",
+		"model_not_in_tier": "The model %s is not available on your tier (%s)",
+		"model_default":     "Model reset, using the default model: %s",
+		"model_info":        "Model: %s\nContext window: %d tokens\nPrice: $%.2f / $%.2f per 1M tokens (input / output)\nVision: %s\nFunction calling: %s\nJSON mode: %s",
+		"model_unknown":     "Model %s is not in the model table, no details available",
+		"yes":               "yes",
+		"no":                "no",
+
+		"raw_usage":   "Please specify a prompt after /raw",
+		"think_usage": "Usage: /think <question> — a reasoning model answers, the question is not added to the history",
+
+		"doc_unsupported": "Only .txt and .md text documents are supported",
+		"doc_too_large":   "The document is too large, the limit is %d KB",
+		"doc_error":       "Failed to read the document",
+
+		"length_usage":   "Usage: /length short|medium|long|default",
+		"length_invalid": "Allowed values: short, medium, long, default",
+		"length_set":     "Response length set to %s",
+
+		"json_usage": "Usage: /json on|off",
+		"json_on":    "JSON mode on: answers will be returned as a JSON object",
+		"json_off":   "JSON mode off",
+
+		"seed_usage":            "Usage: /seed <number>|off",
+		"seed_invalid":          "Seed must be an integer",
+		"seed_set":              "Seed set to %d",
+		"seed_off":              "Seed cleared",
+		"topp_usage":            "Usage: /topp <value from 0 to 1>|off",
+		"topp_current":          "Current top_p: %g",
+		"topp_invalid":          "top_p must be a number from 0 to 1",
+		"topp_set":              "top_p set to %g",
+		"topp_off":              "top_p cleared",
+		"topp_with_temperature": "Note: the bot also sets a temperature, and adjusting both at once is not recommended",
+		"params_header":         "Request parameters:",
+		"params_not_set":        "not set (model default)",
+		"params_model_override": "(from MODEL_DEFAULTS)",
+		"params_random":         "random from %g to %g",
+		"params_auto":           "fitted to the remaining context",
+		"params_system_prompt":  "system prompt",
+		"params_prompt_custom":  "yours (/system)",
+		"params_prompt_default": "default",
+		"params_prompt_none":    "none",
+
+		"broadcast_usage": "Please specify the text after /broadcast",
+		"broadcast_error": "Failed to list users",
+		"broadcast_done":  "Broadcast finished: %d delivered, %d failed",
+
+		"debug_usage":        "Usage: /debug <user_id> on|off",
+		"debug_on":           "Verbose request logging enabled for user %d",
+		"debug_off":          "Verbose request logging disabled for user %d",
+		"maintenance_usage":  "Usage: /maintenance on|off",
+		"maintenance_active": "Maintenance mode is on",
+		"maintenance_on":     "Maintenance mode on: users get the maintenance notice and no OpenAI requests are made",
+		"maintenance_off":    "Maintenance mode off",
+		"maintenance_notice": "The bot is down for maintenance. Please try again later",
+		"lasterror_usage":    "Usage: /lasterror <user_id>",
+		"lasterror_none":     "No errors recorded for user %d",
+		"spendcap_usage":     "Usage: /spendcap or /spendcap reset",
+		"spendcap_disabled":  "No spend cap is configured (SPEND_CAP)",
+		"spendcap_status":    "Spent $%.2f of $%.2f since %s",
+		"spendcap_reached":   "The cap is reached, OpenAI requests are stopped",
+		"version":            "Version: %s\nGo: %s\nUptime: %s (since %s)",
+		"tier_usage":         "Usage: /tier <user_id> <tier>",
+		"tier_unknown":       "Unknown tier %q",
+		"tier_set":           "User %d moved to tier %s",
+		"lasterror":          "Last error of user %d\nKind: %s\nMessage: %s\nTime: %s\nRequest: req %d",
+
+		"export_all_started":   "Exporting all conversations. With a large database this may take a while and produce a big file",
+		"export_error":         "Failed to export your conversation",
+		"export_empty":         "There are no stored messages",
+		"export_done":          "Your conversation, %d messages",
+		"export_too_large":     "The export file (%d MB) exceeds Telegram's 50 MB limit",
+		"import_usage":         "Send an export .json file with /import as its caption to restore the conversation into the current session",
+		"import_too_large":     "The file is too large, the limit is %d KB",
+		"import_invalid":       "This doesn't look like an export file: %v",
+		"import_empty":         "The file has no messages",
+		"import_stateless":     "History is not being stored right now, so there is nothing to import into",
+		"import_error":         "Failed to import the conversation",
+		"import_done":          "Imported %d messages into session %s",
+		"export_all_error":     "Failed to export conversations",
+		"export_all_done":      "Messages exported: %d",
+		"export_all_saved":     "Messages exported: %d. File saved to %s",
+		"export_all_too_large": "The export file (%d MB) exceeds Telegram's 50 MB limit. Set EXPORT_DIR to keep exports on the server",
+
+		"reset_error":      "Failed to clear the history",
+		"reset_done":       "Conversation history cleared",
+		"session_ended":    "Conversation ended and history cleared. Write whenever you want to start over",
+		"reset_stateless":  "History is not kept (stateless mode), previously stored messages were removed",
+		"inactivity_reset": "It's been a while, so I'm starting fresh",
+
+		"count":      "Messages stored in session %s: %d (yours: %d, replies: %d)",
+		"again_none": "There is no reply in this session yet",
+
+		"stateless_usage":  "Usage: /stateless on|off",
+		"stateless_global": "Stateless mode is enabled for everyone by the administrator",
+		"stateless_on":     "Stateless mode on: every message is handled independently",
+		"stateless_off":    "Stateless mode off, the conversation is saved again",
+		"private_usage":    "Usage: /private on|off",
+		"private_on":       "Private mode on: your messages and the replies are no longer stored, and the stored history was removed",
+		"private_off":      "Private mode off, the conversation is saved again",
+
+		"footer_usage": "Usage: /footer on|off",
+		"footer_on":    "Replies will show the model and the estimated cost",
+		"footer_off":   "Replies no longer show the model and cost",
+		"footer_model": "— %s",
+		"footer_cost":  "— %s · ≈$%.4f",
+
+		"verbose_usage": "Usage: /verbose on|off",
+		"verbose_on":    "Replies will show tokens, latency and finish reason",
+		"verbose_off":   "Replies no longer show diagnostics",
+
+		"variants_usage":       "Usage: /variants <1-%d>|off",
+		"variants_set":         "Each message will now get %d alternative answers",
+		"variants_off":         "Each message gets a single answer again",
+		"variants_unsupported": "This bot does not support alternative answers",
+		"variant_header":       "Variant %d",
+		"pick_prompt":          "Which variant should be kept in the history? The first one is kept for now.",
+		"pick_usage":           "Usage: /pick <variant number>",
+		"pick_done":            "Variant %d is kept in the history",
+		"pick_expired":         "Nothing to pick from: the variants have expired or one was already picked",
+		"pick_invalid":         "There is no variant with that number",
+		"pick_error":           "Failed to save the picked variant",
+
+		"session_usage":       "Usage: /session new|switch|delete <name> or /session list",
+		"session_list_error":  "Failed to load sessions",
+		"session_list":        "Sessions:",
+		"session_name_needed": "Please specify a session name: /session %s <name>",
+		"session_name_long":   "Session name must not exceed %d characters",
+		"session_exists":      "Session %s already exists",
+		"session_not_found":   "Session %s not found",
+		"session_create_err":  "Failed to create the session",
+		"session_switch_err":  "Failed to switch the session",
+		"session_delete_err":  "Failed to delete the session",
+		"session_created":     "Session %s created and activated",
+		"session_switched":    "Active session: %s",
+		"session_no_default":  "The default session cannot be deleted",
+		"session_deleted":     "Session %s deleted",
+		"session_deleted_to":  "Session %s deleted, active session is %s",
+		"session_unknown":     "Unknown subcommand. Available: new, switch, list, delete",
+		"session_limit":       "Session limit reached (%d). Delete one with /session delete <name>",
+		"session_evicted":     "Session limit reached, removed the least recently used session %s",
+
+		"lang_usage": "Usage: /lang ru|en|auto",
+		"lang_set":   "Interface language: English",
+		"lang_auto":  "The language will be detected automatically from your messages",
+
+		"system_usage":    "Usage: /system <text> sets the system prompt, /system clear resets it",
+		"system_current":  "Current system prompt:\n%s",
+		"system_set":      "System prompt saved",
+		"system_cleared":  "System prompt cleared",
+		"system_too_long": "The system prompt must not exceed %d characters",
+
+		"preset_usage":       "Usage: /preset save|use|delete <name> or /preset list",
+		"preset_name_needed": "Please specify a preset name: /preset %s <name>",
+		"preset_name_long":   "The preset name must not exceed %d characters",
+		"preset_no_prompt":   "Nothing to save: set a system prompt with /system or give the text after the preset name",
+		"preset_saved":       "Preset %s saved",
+		"preset_used":        "Preset %s is now the system prompt",
+		"preset_deleted":     "Preset %s deleted",
+		"preset_not_found":   "Preset %s not found",
+		"preset_none":        "No saved presets",
+		"preset_list":        "Presets:",
+
+		"cmd_start":       "Start using the bot",
+		"cmd_help":        "List of commands",
+		"cmd_model":       "Choose the OpenAI model, /model info, /model default or /model compare",
+		"cmd_raw":         "One-shot request without history",
+		"cmd_length":      "Response length: short, medium, long",
+		"cmd_json":        "JSON response mode: on or off",
+		"cmd_seed":        "Seed for reproducible answers",
+		"cmd_topp":        "Sampling top_p: 0 to 1, or off",
+		"cmd_params":      "Show the request parameters",
+		"cmd_reset":       "Clear the conversation history",
+		"cmd_stateless":   "Stateless mode: on or off",
+		"cmd_again":       "Send the last reply again",
+		"cmd_private":     "Private mode: on or off",
+		"cmd_session":     "Manage conversation sessions",
+		"cmd_lang":        "Interface language: ru, en or auto",
+		"cmd_broadcast":   "Broadcast to all users",
+		"cmd_export_all":  "Export all conversations",
+		"cmd_export":      "Export your conversation",
+		"cmd_system":      "System prompt",
+		"cmd_preset":      "Library of system prompts",
+		"cmd_footer":      "Show model and cost under replies: on or off",
+		"cmd_count":       "How many messages are stored in the session",
+		"cmd_debug":       "Verbose logs for a user",
+		"cmd_maintenance": "Maintenance mode: on or off",
+		"cmd_variants":    "Several alternative answers: 1-4 or off",
+		"cmd_pick":        "Pick the answer variant to keep",
+		"cmd_think":       "Ask a reasoning model",
+		"cmd_lasterror":   "Last error of a user",
+		"cmd_tier":        "Set a user's tier",
+		"cmd_verbose":     "Diagnostics under replies: on or off",
+		"cmd_version":     "Bot version and uptime",
+		"cmd_import":      "Restore a conversation from an export file",
+		"cmd_spendcap":    "Spend cap: status or reset",
+	},
+}
+
+// loadCatalogOverrides replaces catalog entries with the ones from a JSON
+// file shaped like {"<lang>": {"<key>": "<text>"}}, letting operators
+// reword any fixed message. Unknown keys are reported and ignored.
+func loadCatalogOverrides(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var overrides map[string]map[string]string
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	for lang, entries := range overrides {
+		if _, ok := catalog[lang]; !ok {
+			log.Printf("Warning: %s: unknown language %q, skipping", path, lang)
+			continue
+		}
+		for key, text := range entries {
+			if _, ok := catalog[defaultLang][key]; !ok {
+				log.Printf("Warning: %s: unknown message key %q, skipping", path, key)
+				continue
+			}
+			catalog[lang][key] = text
+		}
+	}
+	return nil
+}
+
+// replyLanguageHints tell the model which language to answer in.
+var replyLanguageHints = map[string]string{
+	"ru": "Unless asked otherwise, reply in Russian.",
+	"en": "Unless asked otherwise, reply in English.",
+}
+
+// tr returns the catalog string for key in lang, falling back to the
+// default language and finally to the key itself.
+func tr(lang, key string, args ...interface{}) string {
+	text, ok := catalog[lang][key]
+	if !ok {
+		text, ok = catalog[defaultLang][key]
+	}
+	if !ok {
+		return key
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(text, args...)
+	}
+	return text
+}
+
+// minDetectLetters is how many letters a message needs before its
+// language is trusted.
+const minDetectLetters = 3
+
+// detectedLangs caches the last language detected per user.
+var detectedLangs sync.Map // map[int64]string
+
+// detectLanguage guesses the language of text from its script. It returns
+// "" when there are too few letters to tell.
+func detectLanguage(text string) string {
+	var cyrillic, latin int
+	for _, r := range text {
+		switch {
+		case unicode.Is(unicode.Cyrillic, r):
+			cyrillic++
+		case unicode.Is(unicode.Latin, r):
+			latin++
+		}
+	}
+	if cyrillic+latin < minDetectLetters {
+		return ""
+	}
+	if cyrillic >= latin {
+		return "ru"
+	}
+	return "en"
+}
+
+// userLang resolves the language for replying to message: the explicit
+// /lang preference, then the language of the message itself, then the last
+// detected one, then the Telegram client language.
+func userLang(prefs UserPrefs, message *tgbotapi.Message) string {
+	if _, ok := catalog[prefs.Lang]; ok {
+		return prefs.Lang
+	}
+	if !message.IsCommand() {
+		if lang := detectLanguage(message.Text); lang != "" {
+			detectedLangs.Store(message.From.ID, lang)
+			return lang
+		}
+	}
+	return fallbackLang(message.From)
+}
+
+// fallbackLang is the language for updates without text of their own,
+// such as button presses: the last detected one, then the Telegram
+// client's language.
+func fallbackLang(user *tgbotapi.User) string {
+	if lang, ok := detectedLangs.Load(user.ID); ok {
+		return lang.(string)
+	}
+	if _, ok := catalog[user.LanguageCode]; ok {
+		return user.LanguageCode
+	}
+	return defaultLang
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"ai_tg_bot/config"
+)
+
+// isImportCommand reports whether a document caption is /import, the way
+// an export file is sent back to the bot.
+func isImportCommand(caption string) bool {
+	fields := strings.Fields(caption)
+	if len(fields) == 0 {
+		return false
+	}
+	name, _, _ := strings.Cut(fields[0], "@")
+	return name == "/import"
+}
+
+// parseImport reads an export file: a JSON array of exportRecord. A role
+// other than user, assistant or summary, an empty message or an unknown
+// field rejects the file.
+func parseImport(data []byte) ([]exportRecord, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var records []exportRecord
+	if err := dec.Decode(&records); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after the message list")
+	}
+	for i, r := range records {
+		switch r.Role {
+		case "user", "assistant", summaryRole:
+		default:
+			return nil, fmt.Errorf("message %d: unknown role %q", i+1, r.Role)
+		}
+		if strings.TrimSpace(r.Content) == "" {
+			return nil, fmt.Errorf("message %d: empty content", i+1)
+		}
+	}
+	return records, nil
+}
+
+// importHistory restores an uploaded export file into the user's active
+// session, after the messages already there. Messages of every session in
+// the file go to the active one, in file order.
+func importHistory(bot *tgbotapi.BotAPI, collection *mongo.Collection, cfg *config.Config, message *tgbotapi.Message, lang string) {
+	userID, chatID := message.From.ID, message.Chat.ID
+	doc := message.Document
+
+	if strings.ToLower(filepath.Ext(doc.FileName)) != ".json" {
+		bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "import_usage")))
+		return
+	}
+	if doc.FileSize > cfg.ImportMaxBytes {
+		bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "import_too_large", cfg.ImportMaxBytes/1024)))
+		return
+	}
+
+	content, err := downloadDocument(bot, doc.FileID, cfg.ImportMaxBytes)
+	if err == errDocumentTooLarge {
+		bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "import_too_large", cfg.ImportMaxBytes/1024)))
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to download import file %q: %v", doc.FileName, err)
+		sendError(bot, chatID, tr(lang, "doc_error"))
+		return
+	}
+	records, err := parseImport([]byte(content))
+	if err != nil {
+		bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "import_invalid", err)))
+		return
+	}
+	if len(records) == 0 {
+		bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "import_empty")))
+		return
+	}
+
+	mu := userLock(userID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	prefs, err := getUserPrefs(collection, userID)
+	if err != nil {
+		sendError(bot, chatID, tr(lang, "prefs_error"))
+		return
+	}
+	if cfg.Stateless || prefs.Stateless || prefs.Private {
+		bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "import_stateless")))
+		return
+	}
+
+	// History is ordered by created_at, so the messages get timestamps a
+	// millisecond apart, ending now but starting after the latest message
+	// already in the session.
+	session := prefs.Session()
+	at := time.Now().Add(-time.Duration(len(records)) * time.Millisecond)
+	if latest, err := loadChatHistory(collection, userID, session, 1); err != nil {
+		log.Printf("Failed to load chat history: %v", err)
+	} else if len(latest) > 0 && !latest[0].CreatedAt.Before(at) {
+		at = latest[0].CreatedAt.Add(time.Millisecond)
+	}
+	messages := make([]ChatMessage, len(records))
+	for i, r := range records {
+		messages[i] = ChatMessage{UserID: userID, Session: session, Role: r.Role, Content: r.Content, CreatedAt: at}
+		at = at.Add(time.Millisecond)
+	}
+	if err := appendChatMessages(collection, userID, session, messages...); err != nil {
+		log.Printf("Failed to import history of user %d: %v", userID, err)
+		sendError(bot, chatID, tr(lang, "import_error"))
+		return
+	}
+	if cfg.HistoryKeepMessages > 0 {
+		if _, err := trimSessionHistory(collection, userID, session, cfg.HistoryKeepMessages); err != nil {
+			log.Printf("Failed to trim chat history of user %d: %v", userID, err)
+		}
+	}
+	if err := touchSession(collection, userID, session); err != nil {
+		log.Printf("Failed to update last use of session %q: %v", session, err)
+	}
+	log.Printf("Imported %d messages into session %q of user %d", len(messages), session, userID)
+	bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "import_done", len(messages), session)))
+}
@@ -0,0 +1,29 @@
+package main
+
+import "sync"
+
+var (
+	inFlightMu sync.Mutex
+	inFlight   = map[int64]int{} // OpenAI requests per user being processed
+)
+
+// beginUserRequest counts a new OpenAI request of userID, unless the user
+// already has max of them in flight (a max of 0 means no limit). Requests
+// over the limit are rejected rather than queued behind the user's lock,
+// so a user can't pile up work by sending messages in quick succession.
+// The returned func ends the request.
+func beginUserRequest(userID int64, max int) (end func(), ok bool) {
+	inFlightMu.Lock()
+	defer inFlightMu.Unlock()
+	if max > 0 && inFlight[userID] >= max {
+		return nil, false
+	}
+	inFlight[userID]++
+	return func() {
+		inFlightMu.Lock()
+		defer inFlightMu.Unlock()
+		if inFlight[userID]--; inFlight[userID] <= 0 {
+			delete(inFlight, userID)
+		}
+	}, true
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"ai_tg_bot/config"
+)
+
+// inlineTimeout keeps inline answers within the window Telegram still
+// accepts them in.
+const inlineTimeout = 15 * time.Second
+
+// inlineTitleLen bounds the answer preview shown in the inline popup.
+const inlineTitleLen = 100
+
+// latestInlineQuery holds the ID of each user's latest inline query, for
+// debouncing.
+var latestInlineQuery sync.Map // map[int64]string
+
+// handleInlineQuery answers "@bot query" with a single article generated by
+// a stateless, length-capped request. Telegram sends a query for every
+// keystroke, so only the query the user stopped typing at is answered, and
+// like a chat message it is subject to the in-flight limit, the denylist,
+// the daily quota and the budget.
+func handleInlineQuery(bot *tgbotapi.BotAPI, collection *mongo.Collection, cfg *config.Config, query *tgbotapi.InlineQuery) {
+	text := strings.TrimSpace(query.Query)
+	if utf8.RuneCountInString(text) < max(cfg.InlineMinChars, 1) {
+		return
+	}
+
+	userID := query.From.ID
+	latestInlineQuery.Store(userID, query.ID)
+	time.Sleep(cfg.InlineDebounce)
+	if latest, _ := latestInlineQuery.Load(userID); latest != query.ID {
+		return
+	}
+	latestInlineQuery.CompareAndDelete(userID, query.ID)
+
+	endRequest, ok := beginUserRequest(userID, cfg.MaxUserRequests)
+	if !ok {
+		return
+	}
+	defer endRequest()
+	if !allowInput(bot, userID, 0, "", text) {
+		return
+	}
+	mu := userLock(userID)
+	mu.Lock()
+	allowed := checkDailyQuota(bot, collection, cfg, userID, 0, "")
+	mu.Unlock()
+	if !allowed {
+		return
+	}
+
+	prefs, err := getUserPrefs(collection, userID)
+	if err != nil {
+		log.Printf("Failed to load user prefs: %v", err)
+	}
+	model := budgetModel(bot, collection, cfg, userID, 0, "", requestModel(collection, cfg, userID, prefs))
+
+	var messages []OpenAIMessage
+	if hint, ok := replyLanguageHints[detectLanguage(text)]; ok {
+		messages = append(messages, OpenAIMessage{Role: "system", Content: hint})
+	}
+	messages = append(messages, OpenAIMessage{Role: "user", Content: text})
+
+	reqBody := OpenAIRequest{
+		Model:     model,
+		Messages:  messages,
+		MaxTokens: cfg.InlineMaxTokens,
+		User:      hashUserID(cfg.UserHashSalt, userID),
+	}
+
+	ctx, cancel := requestContext(cfg, userID)
+	defer cancel()
+	ctx, cancelInline := context.WithTimeout(ctx, inlineTimeout)
+	defer cancelInline()
+
+	resp, err := callOpenAI(ctx, reqBody)
+	if err != nil {
+		log.Printf("Inline query from user %d failed: %v", userID, err)
+		return
+	}
+	recordUsage(collection, userID, resp)
+	answer := resp.Choices[0].Message.Content
+
+	title := []rune(answer)
+	if len(title) > inlineTitleLen {
+		title = append(title[:inlineTitleLen], '…')
+	}
+	article := tgbotapi.NewInlineQueryResultArticle(strconv.FormatInt(time.Now().UnixNano(), 36), text, answer)
+	article.Description = string(title)
+
+	inlineConf := tgbotapi.InlineConfig{
+		InlineQueryID: query.ID,
+		Results:       []interface{}{article},
+		IsPersonal:    true,
+	}
+	if _, err := bot.Request(inlineConf); err != nil {
+		log.Printf("Failed to answer inline query: %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// keyRateLimitCooldown rests a key after a 429 rate-limit response.
+	keyRateLimitCooldown = 30 * time.Second
+	// keyDisabledCooldown rests a key that is out of quota or rejected.
+	keyDisabledCooldown = 10 * time.Minute
+)
+
+// keyPool hands out OpenAI API keys round-robin, skipping keys that are
+// cooling down after rate-limit or auth errors.
+type keyPool struct {
+	mu        sync.Mutex
+	keys      []string
+	coolUntil []time.Time
+	next      int
+}
+
+func newKeyPool(keys []string) *keyPool {
+	return &keyPool{keys: keys, coolUntil: make([]time.Time, len(keys))}
+}
+
+// apiKeys is the pool every OpenAI call draws from. Set at startup.
+var apiKeys = newKeyPool(nil)
+
+// Pick returns the next key that is not cooling down. If all of them are,
+// it returns the one that recovers first rather than failing outright.
+func (p *keyPool) Pick() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.keys) == 0 {
+		return ""
+	}
+	now := time.Now()
+	best := -1
+	for i := range p.keys {
+		idx := (p.next + i) % len(p.keys)
+		if !p.coolUntil[idx].After(now) {
+			best = idx
+			break
+		}
+		if best == -1 || p.coolUntil[idx].Before(p.coolUntil[best]) {
+			best = idx
+		}
+	}
+	p.next = (best + 1) % len(p.keys)
+	return p.keys[best]
+}
+
+// Report puts key on cooldown when err shows it is rate limited, out of
+// quota or rejected.
+func (p *keyPool) Report(key string, err error) {
+	var cooldown time.Duration
+	switch classifyOpenAIError(err) {
+	case errKindRateLimit:
+		cooldown = keyRateLimitCooldown
+	case errKindQuota, errKindAuth:
+		cooldown = keyDisabledCooldown
+	default:
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, k := range p.keys {
+		if k == key {
+			p.coolUntil[i] = time.Now().Add(cooldown)
+		}
+	}
+}
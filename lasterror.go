@@ -0,0 +1,34 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// lastError is the most recent failure a user ran into, kept for support.
+type lastError struct {
+	Kind      string // an errKind* or "internal"
+	Message   string
+	At        time.Time
+	RequestID int // the [req N] of the logs
+}
+
+// lastErrors holds the last error per user, in memory only.
+var lastErrors sync.Map // int64 -> lastError
+
+func recordLastError(userID int64, requestID int, kind string, err error) {
+	lastErrors.Store(userID, lastError{Kind: kind, Message: err.Error(), At: time.Now().UTC(), RequestID: requestID})
+}
+
+// recordOpenAIError records a failed OpenAI call under its error kind.
+func recordOpenAIError(userID int64, requestID int, err error) {
+	recordLastError(userID, requestID, classifyOpenAIError(err), err)
+}
+
+func getLastError(userID int64) (lastError, bool) {
+	v, ok := lastErrors.Load(userID)
+	if !ok {
+		return lastError{}, false
+	}
+	return v.(lastError), true
+}
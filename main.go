@@ -3,15 +3,21 @@ package main
 import (
 	"context"
 	"log"
+	"strconv"
 	"strings"
+	"time"
 
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"runtime/debug"
+	"slices"
+	"unicode/utf8"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
@@ -26,43 +32,240 @@ const (
 )
 
 type ChatMessage struct {
-	UserID  int64  `bson:"user_id"`
-	Role    string `bson:"role"` // "user" or "assistant"
-	Content string `bson:"content"`
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	UserID    int64              `bson:"user_id"`
+	Session   string             `bson:"session,omitempty"`
+	Role      string             `bson:"role"` // "user", "assistant" or summaryRole
+	Content   string             `bson:"content"`
+	CreatedAt time.Time          `bson:"created_at,omitempty"` // zero on messages saved before timestamps existed
 }
 
 type OpenAIRequest struct {
-	Model    string          `json:"model"`
-	Messages []OpenAIMessage `json:"messages"`
+	Model       string          `json:"model"`
+	Messages    []OpenAIMessage `json:"messages"`
+	MaxTokens   int             `json:"max_tokens,omitempty"`
+	Temperature *float64        `json:"temperature,omitempty"`
+	TopP        *float64        `json:"top_p,omitempty"`
+
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+	Seed           *int            `json:"seed,omitempty"`
+	N              *int            `json:"n,omitempty"` // chat completions only
+
+	// Reasoning models take max_completion_tokens instead of max_tokens.
+	MaxCompletionTokens int    `json:"max_completion_tokens,omitempty"`
+	ReasoningEffort     string `json:"reasoning_effort,omitempty"` // "low", "medium" or "high"
+	User                string `json:"user,omitempty"`
+
+	// Modalities ["text", "audio"] asks an audio-capable model to speak
+	// its reply, in the voice and format of Audio.
+	Modalities []string      `json:"modalities,omitempty"`
+	Audio      *AudioOptions `json:"audio,omitempty"`
+
+	LogitBias map[string]float64 `json:"logit_bias,omitempty"`
+	Stream    bool               `json:"stream,omitempty"`
+
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+}
+
+// StreamOptions configures a streamed completion. IncludeUsage adds a
+// final chunk carrying the token usage of the whole response.
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// ResponseFormat selects the output format, e.g. {"type": "json_object"}.
+type ResponseFormat struct {
+	Type string `json:"type"`
 }
 
 type OpenAIMessage struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+
+	Audio *MessageAudio `json:"audio,omitempty"` // spoken reply, responses only
 }
 
 type OpenAIResponse struct {
-	Choices []struct {
-		Message OpenAIMessage `json:"message"`
-	} `json:"choices"`
+	Model             string         `json:"model"` // the model that actually answered
+	Choices           []OpenAIChoice `json:"choices"`
+	Usage             *Usage         `json:"usage"`
+	SystemFingerprint string         `json:"system_fingerprint"`
+	Error             *APIError      `json:"error"`
+}
+
+type OpenAIChoice struct {
+	Message      OpenAIMessage `json:"message"`
+	FinishReason string        `json:"finish_reason"`
+}
+
+// APIError is the error object returned by the OpenAI API.
+type APIError struct {
+	StatusCode int    `json:"-"`
+	Type       string `json:"type"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
 }
 
+func (e *APIError) Error() string {
+	return fmt.Sprintf("openai: %s (status %d, code %q)", e.Message, e.StatusCode, e.Code)
+}
+
+// isContextLengthError reports whether err means the prompt did not fit
+// into the model's context window.
+func isContextLengthError(err error) bool {
+	return errors.Is(err, ErrContextLength)
+}
+
+// openAIBreaker guards every OpenAI call; it is reconfigured from the
+// config at startup.
+var openAIBreaker = newCircuitBreaker(5, 30*time.Second)
+
+// maxContextRetries bounds how many times a turn is retried with a
+// shortened history after a context-length error.
+const maxContextRetries = 3
+
 func main() {
 	cfg := config.LoadConfig()
-	if cfg.TelegramBotToken == "" || cfg.OpenAIAPIKey == "" || cfg.MongoURI == "" {
-		log.Fatal("TELEGRAM_BOT_TOKEN, OPENAI_API_KEY and MONGO_URI environment variables must be set")
+	log.Printf("Starting ai_tg_bot %s", buildVersion())
+	if cfg.TelegramBotToken == "" || len(cfg.OpenAIAPIKeys) == 0 || cfg.MongoURI == "" {
+		log.Fatal("TELEGRAM_BOT_TOKEN, OPENAI_API_KEY (or OPENAI_API_KEYS) and MONGO_URI environment variables must be set")
+	}
+
+	if cfg.MessagesFile != "" {
+		if err := loadCatalogOverrides(cfg.MessagesFile); err != nil {
+			log.Fatalf("Failed to load message overrides: %v", err)
+		}
+	}
+
+	if cfg.FewShotFile != "" {
+		messages, err := loadFewShotMessages(cfg.FewShotFile)
+		if err != nil {
+			log.Fatalf("Failed to load few-shot messages: %v", err)
+		}
+		fewShotMessages = messages
+		log.Printf("Loaded %d few-shot messages", len(fewShotMessages))
+	}
+
+	setDefaultSystemPrompt(cfg.DefaultSystemPrompt)
+	if cfg.DefaultSystemPromptFile != "" {
+		if err := loadDefaultSystemPrompt(cfg.DefaultSystemPromptFile); err != nil {
+			log.Fatalf("Failed to load default system prompt: %v", err)
+		}
+		go watchDefaultSystemPrompt(cfg.DefaultSystemPromptFile, cfg.SystemPromptReloadInterval)
+	}
+
+	if cfg.TemperatureRange != nil && cfg.DefaultParams.Temperature != nil {
+		log.Println("Warning: DEFAULT_TEMPERATURE and TEMPERATURE_RANGE are mutually exclusive, ignoring TEMPERATURE_RANGE")
+		cfg.TemperatureRange = nil
+	}
+
+	denylistEntries := cfg.Denylist
+	if cfg.DenylistFile != "" {
+		entries, err := loadDenylistFile(cfg.DenylistFile)
+		if err != nil {
+			log.Fatalf("Failed to load denylist: %v", err)
+		}
+		denylistEntries = append(denylistEntries, entries...)
+	}
+	patterns, err := compileDenylist(denylistEntries)
+	if err != nil {
+		log.Fatalf("Invalid denylist: %v", err)
+	}
+	denylist = patterns
+
+	// Preprocessors run in this order: the prompt template goes last so
+	// that it wraps everything the other processors added.
+	if cfg.FetchURLs {
+		registerPreProcessor(linkedPagesProcessor(cfg.FetchMaxChars))
+	}
+	if cfg.PromptTemplate != "" {
+		tmpl, err := parsePromptTemplate(cfg.PromptTemplate)
+		if err != nil {
+			log.Fatalf("Invalid PROMPT_TEMPLATE: %v", err)
+		}
+		registerPreProcessor(promptTemplateProcessor(tmpl))
+	}
+	if len(cfg.StripTags) > 0 {
+		stripper, err := tagStripper(cfg.StripTags)
+		if err != nil {
+			log.Fatalf("Invalid STRIP_TAGS: %v", err)
+		}
+		registerPostProcessor(stripper)
+	}
+	if cfg.StripWrappingQuotes {
+		registerPostProcessor(stripWrappingQuotes)
+		holdOpeningQuote = true
+	}
+	if cfg.TrimResponses {
+		registerPostProcessor(trimSpace)
 	}
 
 	// Connect to MongoDB
-	client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(cfg.MongoURI))
+	clientOpts, err := clientOptions(cfg)
+	if err != nil {
+		log.Fatalf("Invalid MongoDB settings: %v", err)
+	}
+	client, err := mongo.Connect(context.TODO(), clientOpts)
 	if err != nil {
 		log.Fatalf("Failed to connect to MongoDB: %v", err)
 	}
 	defer client.Disconnect(context.TODO())
 
-	collection := client.Database(databaseName).Collection(collectionName)
+	collOpts, err := collectionOptions(cfg)
+	if err != nil {
+		log.Fatalf("Invalid MongoDB settings: %v", err)
+	}
+	collection := client.Database(databaseName).Collection(collectionName, collOpts)
+
+	if cfg.UpdateDedupTTL > 0 {
+		if err := ensureUpdateIndexes(collection); err != nil {
+			log.Printf("Warning: failed to create update dedup indexes, redelivered updates won't be detected: %v", err)
+			cfg.UpdateDedupTTL = 0
+		}
+	}
+
+	if err := loadMaintenance(collection); err != nil {
+		log.Printf("Warning: failed to load maintenance mode, assuming off: %v", err)
+	}
+	if maintenance.Load() {
+		log.Printf("Starting in maintenance mode")
+	}
+
+	if cfg.UserHashSalt == "" {
+		if cfg.UserHashSalt, err = loadUserHashSalt(collection); err != nil {
+			log.Fatalf("Failed to load the user hash salt, set USER_HASH_SALT: %v", err)
+		}
+	}
+
+	if err := startSpendCapWatcher(collection, cfg.SpendCap); err != nil {
+		log.Fatalf("Failed to load spend cap state: %v", err)
+	}
+	startHistoryTrimmer(collection, cfg.HistoryTrimInterval, cfg.HistoryMaxMessages)
+	startSaveRetrier(collection, cfg.SaveRetryQueueSize)
 
-	bot, err := tgbotapi.NewBotAPI(cfg.TelegramBotToken)
+	openAIBreaker = newCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown)
+	errorDeleteAfter = cfg.ErrorDeleteAfter
+	openAIMaxRetries = cfg.OpenAIMaxRetries
+	openAIRetryBackoff = cfg.OpenAIRetryBackoff
+	maxStoredMessageBytes = cfg.MaxStoredMessageBytes
+	if provider, err = newProvider(cfg.OpenAIAPI); err != nil {
+		log.Fatalf("Invalid OPENAI_API: %v", err)
+	}
+	if cfg.OpenAIAPI == "azure" {
+		if chatRequest, err = newAzureChatRequest(cfg.AzureEndpoint, cfg.AzureDeployment, cfg.AzureAPIVersion); err != nil {
+			log.Fatalf("Invalid Azure OpenAI settings: %v", err)
+		}
+	}
+	apiKeys = newKeyPool(cfg.OpenAIAPIKeys)
+	if openAIClient, err = newOpenAIClient(cfg.OpenAIProxy, cfg.OpenAIHeaders, cfg.OpenAIThrottle); err != nil {
+		log.Fatalf("Invalid OPENAI_PROXY: %v", err)
+	}
+	startMetricsServer(cfg.MetricsAddr)
+	if err := startMetricsExporter(cfg); err != nil {
+		log.Fatalf("Failed to start metrics exporter: %v", err)
+	}
+
+	bot, err := tgbotapi.NewBotAPIWithClient(cfg.TelegramBotToken, tgbotapi.APIEndpoint, newSendGovernor(&http.Client{}))
 	if err != nil {
 		log.Fatalf("Failed to create Telegram bot: %v", err)
 	}
@@ -70,97 +273,1071 @@ func main() {
 	bot.Debug = false
 	log.Printf("Authorized on account %s", bot.Self.UserName)
 
+	registerCommands(bot, cfg)
+
 	u := tgbotapi.NewUpdate(0)
 	u.Timeout = 60
 
-	updates := bot.GetUpdatesChan(u)
+	updates := pollUpdates(bot, u)
 
-	for update := range updates {
-		if update.Message == nil {
-			continue
+	// Messages are handled on a goroutine per chat, in order within each
+	// chat, so that replies the send governor holds back for one chat
+	// never stall the update loop for everyone else.
+	chats := newChatQueues()
+	handleMessage := func(update tgbotapi.Update) {
+		// Service messages about joins carry no text for the model.
+		if len(update.Message.NewChatMembers) > 0 {
+			welcomeNewMembers(bot, cfg, update.Message)
+			return
 		}
 
 		userID := update.Message.From.ID
 		text := update.Message.Text
 
-		if strings.HasPrefix(text, "/start") {
-			msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Привет! Отправь сообщение, и я отвечу с помощью OpenAI. Можно выбрать модель командой /model <имя_модели> (например, gpt-3.5-turbo). По умолчанию используется gpt-3.5-turbo.")
+		// Model and prefs live under prefsID, which is the group's rather
+		// than the user's in groups with GROUP_SETTINGS on.
+		prefsID := settingsID(cfg, update.Message)
+		userPrefs, err := loadPrefs(collection, userID, prefsID)
+		if err != nil {
+			log.Printf("Failed to load user prefs: %v", err)
+		}
+		lang := userLang(userPrefs, update.Message)
+
+		// During maintenance only admins get through, so they can still
+		// switch it off.
+		if maintenance.Load() && !cfg.IsAdmin(userID) {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, maintenanceNotice(cfg.MaintenanceMessage, lang))
 			bot.Send(msg)
-			continue
+			return
 		}
 
-		if strings.HasPrefix(text, "/model") {
+		if command := update.Message.Command(); command != "" {
+			if wait := checkCooldown(userID, command, cfg.CommandCooldowns[command]); wait > 0 {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "cooldown", (wait+time.Second-1).Truncate(time.Second), command))
+				bot.Send(msg)
+				return
+			}
+		}
+
+		if prefsID != userID && changesSettings(update.Message.Command(), update.Message.CommandArguments()) {
+			admin, err := isChatAdmin(bot, update.Message.Chat.ID, userID)
+			if err != nil {
+				log.Printf("Failed to check admin rights of user %d in chat %d: %v", userID, update.Message.Chat.ID, err)
+				sendError(bot, update.Message.Chat.ID, tr(lang, "group_admin_error"))
+				return
+			}
+			if !admin {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "group_admin_only"))
+				bot.Send(msg)
+				return
+			}
+		}
+
+		if update.Message.Document != nil && isImportCommand(update.Message.Caption) {
+			go func(requestID int, message *tgbotapi.Message) {
+				defer recoverPanic(bot, message.Chat.ID, lang, requestID)
+				importHistory(bot, collection, cfg, message, lang)
+			}(update.UpdateID, update.Message)
+			return
+		}
+		if update.Message.Document != nil {
+			endRequest, ok := beginUserRequest(userID, cfg.MaxUserRequests)
+			if !ok {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "request_in_progress"))
+				bot.Send(msg)
+				return
+			}
+			go func(requestID int, message *tgbotapi.Message) {
+				defer recoverPanic(bot, message.Chat.ID, lang, requestID)
+				defer endRequest()
+				handleDocument(bot, collection, cfg, requestID, message, lang)
+			}(update.UpdateID, update.Message)
+			return
+		}
+
+		switch update.Message.Command() {
+		case "start":
+			if cfg.WelcomeSticker != "" {
+				sticker := tgbotapi.NewSticker(update.Message.Chat.ID, requestFile(cfg.WelcomeSticker))
+				if _, err := bot.Send(sticker); err != nil {
+					log.Printf("Failed to send welcome sticker: %v", err)
+				}
+			}
+			if cfg.WelcomePhoto != "" {
+				photo := tgbotapi.NewPhoto(update.Message.Chat.ID, requestFile(cfg.WelcomePhoto))
+				if _, err := bot.Send(photo); err != nil {
+					log.Printf("Failed to send welcome photo: %v", err)
+				}
+			}
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "start"))
+			bot.Send(msg)
+			return
+		case "help":
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, helpText(cfg, update.Message, lang))
+			bot.Send(msg)
+			return
+		case "model":
 			parts := strings.Split(text, " ")
 			if len(parts) < 2 {
-				msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Пожалуйста, укажите имя модели после команды /model")
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "model_usage"))
+				bot.Send(msg)
+				return
+			}
+			if parts[1] == "compare" {
+				models, prompt, ok := parseCompareArgs(update.Message.CommandArguments())
+				if !ok {
+					msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "compare_usage"))
+					bot.Send(msg)
+					return
+				}
+				tier := userTier(cfg, userPrefs)
+				denied := ""
+				for i, m := range models {
+					m = cfg.ResolveModel(m)
+					models[i] = m
+					if !modelAllowed(cfg, tier, m) {
+						denied = m
+						break
+					}
+				}
+				if denied != "" {
+					msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "model_not_in_tier", denied, tier))
+					bot.Send(msg)
+					return
+				}
+				endRequest, ok := beginUserRequest(userID, cfg.MaxUserRequests)
+				if !ok {
+					msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "request_in_progress"))
+					bot.Send(msg)
+					return
+				}
+				go func(requestID int, userID, chatID int64, lang string, models [2]string, prompt string) {
+					defer recoverPanic(bot, chatID, lang, requestID)
+					defer endRequest()
+					compareModels(bot, collection, cfg, requestID, userID, chatID, lang, models, prompt)
+				}(update.UpdateID, userID, update.Message.Chat.ID, lang, models, prompt)
+				return
+			}
+			if parts[1] == "info" {
+				model := requestModel(collection, cfg, prefsID, userPrefs)
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, modelInfoText(lang, model))
+				bot.Send(msg)
+				return
+			}
+			if parts[1] == "default" {
+				if err := deleteUserModel(collection, prefsID); err != nil {
+					sendError(bot, update.Message.Chat.ID, tr(lang, "model_error"))
+					return
+				}
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "model_default", cfg.DefaultModel))
+				bot.Send(msg)
+				return
+			}
+			model := cfg.ResolveModel(parts[1])
+			if tier := userTier(cfg, userPrefs); !modelAllowed(cfg, tier, model) {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "model_not_in_tier", model, tier))
+				bot.Send(msg)
+				return
+			}
+			err := setUserModel(collection, prefsID, model)
+			if err != nil {
+				sendError(bot, update.Message.Chat.ID, tr(lang, "model_error"))
+				return
+			}
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "model_set", model))
+			bot.Send(msg)
+			return
+		case "raw":
+			prompt := strings.TrimSpace(update.Message.CommandArguments())
+			if prompt == "" {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "raw_usage"))
+				bot.Send(msg)
+				return
+			}
+			endRequest, ok := beginUserRequest(userID, cfg.MaxUserRequests)
+			if !ok {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "request_in_progress"))
+				bot.Send(msg)
+				return
+			}
+			go func(requestID int, userID, prefsID int64, chatID int64, lang, prompt string) {
+				defer recoverPanic(bot, chatID, lang, requestID)
+				defer endRequest()
+
+				model := requestModel(collection, cfg, prefsID, userPrefs)
+				reqBody := OpenAIRequest{
+					Model:    model,
+					Messages: []OpenAIMessage{{Role: "user", Content: prompt}},
+					User:     hashUserID(cfg.UserHashSalt, userID),
+				}
+				answerOneShot(bot, collection, cfg, requestID, userID, chatID, lang, reqBody)
+			}(update.UpdateID, userID, prefsID, update.Message.Chat.ID, lang, prompt)
+			return
+		case "think":
+			prompt := strings.TrimSpace(update.Message.CommandArguments())
+			if prompt == "" {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "think_usage"))
+				bot.Send(msg)
+				return
+			}
+			endRequest, ok := beginUserRequest(userID, cfg.MaxUserRequests)
+			if !ok {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "request_in_progress"))
+				bot.Send(msg)
+				return
+			}
+			go func(requestID int, userID int64, chatID int64, lang, prompt string) {
+				defer recoverPanic(bot, chatID, lang, requestID)
+				defer endRequest()
+				answerOneShot(bot, collection, cfg, requestID, userID, chatID, lang, buildThinkRequest(cfg, userID, prompt))
+			}(update.UpdateID, userID, update.Message.Chat.ID, lang, prompt)
+			return
+		case "length":
+			parts := strings.Fields(text)
+			if len(parts) < 2 {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "length_usage"))
 				bot.Send(msg)
-				continue
+				return
+			}
+			length := strings.ToLower(parts[1])
+			var err error
+			if length == "default" {
+				err = unsetUserPref(collection, prefsID, "length")
+			} else if _, ok := lengthPresets[length]; ok {
+				err = setUserPref(collection, prefsID, "length", length)
+			} else {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "length_invalid"))
+				bot.Send(msg)
+				return
 			}
-			model := parts[1]
-			err := setUserModel(collection, userID, model)
 			if err != nil {
-				msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Ошибка при сохранении модели")
+				sendError(bot, update.Message.Chat.ID, tr(lang, "pref_error"))
+				return
+			}
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "length_set", length))
+			bot.Send(msg)
+			return
+		case "json":
+			parts := strings.Fields(text)
+			if len(parts) < 2 || (parts[1] != "on" && parts[1] != "off") {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "json_usage"))
 				bot.Send(msg)
-				continue
+				return
+			}
+			var err error
+			if parts[1] == "on" {
+				err = setUserPref(collection, prefsID, "json_mode", true)
+			} else {
+				err = unsetUserPref(collection, prefsID, "json_mode")
 			}
-			msg := tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("Модель установлена на %s", model))
+			if err != nil {
+				sendError(bot, update.Message.Chat.ID, tr(lang, "pref_error"))
+				return
+			}
+			reply := tr(lang, "json_off")
+			if parts[1] == "on" {
+				reply = tr(lang, "json_on")
+			}
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, reply)
 			bot.Send(msg)
-			continue
+			return
+		case "seed":
+			parts := strings.Fields(text)
+			if len(parts) < 2 {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "seed_usage"))
+				bot.Send(msg)
+				return
+			}
+			var err error
+			var reply string
+			if parts[1] == "off" {
+				err = unsetUserPref(collection, prefsID, "seed")
+				reply = tr(lang, "seed_off")
+			} else {
+				seed, convErr := strconv.Atoi(parts[1])
+				if convErr != nil {
+					msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "seed_invalid"))
+					bot.Send(msg)
+					return
+				}
+				err = setUserPref(collection, prefsID, "seed", seed)
+				reply = tr(lang, "seed_set", seed)
+			}
+			if err != nil {
+				sendError(bot, update.Message.Chat.ID, tr(lang, "pref_error"))
+				return
+			}
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, reply)
+			bot.Send(msg)
+			return
+		case "params":
+			model := requestModel(collection, cfg, prefsID, userPrefs)
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, paramsText(cfg, lang, model, userID, userPrefs))
+			bot.Send(msg)
+			return
+		case "topp":
+			parts := strings.Fields(text)
+			if len(parts) < 2 {
+				reply := tr(lang, "topp_usage")
+				if userPrefs.TopP != nil {
+					reply = tr(lang, "topp_current", *userPrefs.TopP) + "\n\n" + reply
+				}
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, reply)
+				bot.Send(msg)
+				return
+			}
+			var err error
+			var reply string
+			if parts[1] == "off" {
+				err = unsetUserPref(collection, prefsID, "top_p")
+				reply = tr(lang, "topp_off")
+			} else {
+				topP, convErr := strconv.ParseFloat(parts[1], 64)
+				if convErr != nil || topP < 0 || topP > 1 {
+					msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "topp_invalid"))
+					bot.Send(msg)
+					return
+				}
+				err = setUserPref(collection, prefsID, "top_p", topP)
+				reply = tr(lang, "topp_set", topP)
+				model := requestModel(collection, cfg, prefsID, userPrefs)
+				// OpenAI advises tuning temperature or top_p, not both.
+				if cfg.ParamsFor(model).Temperature != nil || cfg.TemperatureRange != nil {
+					reply += "\n\n" + tr(lang, "topp_with_temperature")
+				}
+			}
+			if err != nil {
+				sendError(bot, update.Message.Chat.ID, tr(lang, "pref_error"))
+				return
+			}
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, reply)
+			bot.Send(msg)
+			return
+		case "variants":
+			parts := strings.Fields(text)
+			if len(parts) < 2 {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "variants_usage", maxVariants))
+				bot.Send(msg)
+				return
+			}
+			n, convErr := strconv.Atoi(parts[1])
+			if parts[1] == "off" {
+				n, convErr = 1, nil
+			}
+			if convErr != nil || n < 1 || n > maxVariants {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "variants_usage", maxVariants))
+				bot.Send(msg)
+				return
+			}
+			// The Responses API has no n: it would quietly answer once.
+			if n > 1 && cfg.OpenAIAPI == "responses" {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "variants_unsupported"))
+				bot.Send(msg)
+				return
+			}
+			var err error
+			reply := tr(lang, "variants_off")
+			if n == 1 {
+				err = unsetUserPref(collection, prefsID, "variants")
+			} else {
+				err = setUserPref(collection, prefsID, "variants", n)
+				reply = tr(lang, "variants_set", n)
+			}
+			if err != nil {
+				sendError(bot, update.Message.Chat.ID, tr(lang, "pref_error"))
+				return
+			}
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, reply)
+			bot.Send(msg)
+			return
+		case "pick":
+			index, convErr := strconv.Atoi(strings.TrimSpace(update.Message.CommandArguments()))
+			if convErr != nil {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "pick_usage"))
+				bot.Send(msg)
+				return
+			}
+			key := pickVariant(collection, userID, 0, index-1)
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, pickReply(lang, key, index-1))
+			bot.Send(msg)
+			return
+		case "broadcast":
+			if !cfg.IsAdmin(userID) {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "admin_only"))
+				bot.Send(msg)
+				return
+			}
+			announcement := strings.TrimSpace(update.Message.CommandArguments())
+			if announcement == "" {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "broadcast_usage"))
+				bot.Send(msg)
+				return
+			}
+			go func(requestID int, chatID int64) {
+				defer recoverPanic(bot, chatID, lang, requestID)
+				broadcast(bot, collection, chatID, lang, announcement)
+			}(update.UpdateID, update.Message.Chat.ID)
+			return
+		case "debug":
+			if !cfg.IsAdmin(userID) {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "admin_only"))
+				bot.Send(msg)
+				return
+			}
+			parts := strings.Fields(text)
+			var target int64
+			if len(parts) == 3 {
+				target, err = strconv.ParseInt(parts[1], 10, 64)
+			}
+			if len(parts) != 3 || err != nil || (parts[2] != "on" && parts[2] != "off") {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "debug_usage"))
+				bot.Send(msg)
+				return
+			}
+			setUserDebug(target, parts[2] == "on")
+			log.Printf("Admin %d turned debug logging %s for user %d", userID, parts[2], target)
+			reply := tr(lang, "debug_off", target)
+			if parts[2] == "on" {
+				reply = tr(lang, "debug_on", target)
+			}
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, reply)
+			bot.Send(msg)
+			return
+		case "maintenance":
+			if !cfg.IsAdmin(userID) {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "admin_only"))
+				bot.Send(msg)
+				return
+			}
+			parts := strings.Fields(text)
+			if len(parts) != 2 || (parts[1] != "on" && parts[1] != "off") {
+				reply := tr(lang, "maintenance_usage")
+				if maintenance.Load() {
+					reply = tr(lang, "maintenance_active") + "\n\n" + reply
+				}
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, reply)
+				bot.Send(msg)
+				return
+			}
+			if err := setMaintenance(collection, parts[1] == "on"); err != nil {
+				log.Printf("Failed to store maintenance mode: %v", err)
+				sendError(bot, update.Message.Chat.ID, tr(lang, "db_error"))
+				return
+			}
+			log.Printf("Admin %d turned maintenance mode %s", userID, parts[1])
+			reply := tr(lang, "maintenance_off")
+			if parts[1] == "on" {
+				reply = tr(lang, "maintenance_on")
+			}
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, reply)
+			bot.Send(msg)
+			return
+		case "lasterror":
+			if !cfg.IsAdmin(userID) {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "admin_only"))
+				bot.Send(msg)
+				return
+			}
+			target, err := strconv.ParseInt(strings.TrimSpace(update.Message.CommandArguments()), 10, 64)
+			if err != nil {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "lasterror_usage"))
+				bot.Send(msg)
+				return
+			}
+			reply := tr(lang, "lasterror_none", target)
+			if e, ok := getLastError(target); ok {
+				reply = tr(lang, "lasterror", target, e.Kind, e.Message, e.At.Format(time.RFC3339), e.RequestID)
+			}
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, reply)
+			bot.Send(msg)
+			return
+		case "version":
+			if !cfg.IsAdmin(userID) {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "admin_only"))
+				bot.Send(msg)
+				return
+			}
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, versionText(lang))
+			bot.Send(msg)
+			return
+		case "spendcap":
+			if !cfg.IsAdmin(userID) {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "admin_only"))
+				bot.Send(msg)
+				return
+			}
+			if cfg.SpendCap <= 0 {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "spendcap_disabled"))
+				bot.Send(msg)
+				return
+			}
+			switch strings.TrimSpace(update.Message.CommandArguments()) {
+			case "":
+			case "reset":
+				if err := spendCap.reset(collection); err != nil {
+					log.Printf("Failed to reset spend cap: %v", err)
+					sendError(bot, update.Message.Chat.ID, tr(lang, "db_error"))
+					return
+				}
+				log.Printf("Admin %d reset the spend cap", userID)
+			default:
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "spendcap_usage"))
+				bot.Send(msg)
+				return
+			}
+			spent, limit, since := spendCap.status()
+			reply := tr(lang, "spendcap_status", spent, limit, since.Format(time.RFC3339))
+			if spendCapReached.Load() {
+				reply = tr(lang, "spendcap_reached") + "\n" + reply
+			}
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, reply)
+			bot.Send(msg)
+			return
+		case "tier":
+			if !cfg.IsAdmin(userID) {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "admin_only"))
+				bot.Send(msg)
+				return
+			}
+			parts := strings.Fields(text)
+			var target int64
+			if len(parts) == 3 {
+				target, err = strconv.ParseInt(parts[1], 10, 64)
+			}
+			if len(parts) != 3 || err != nil {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "tier_usage"))
+				bot.Send(msg)
+				return
+			}
+			tier := parts[2]
+			if !validTier(cfg, tier) {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "tier_unknown", tier))
+				bot.Send(msg)
+				return
+			}
+			if tier == cfg.DefaultTier {
+				err = unsetUserPref(collection, target, "tier")
+			} else {
+				err = setUserPref(collection, target, "tier", tier)
+			}
+			if err != nil {
+				sendError(bot, update.Message.Chat.ID, tr(lang, "pref_error"))
+				return
+			}
+			log.Printf("Admin %d moved user %d to tier %q", userID, target, tier)
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "tier_set", target, tier))
+			bot.Send(msg)
+			return
+		case "export":
+			go func(requestID int, userID, chatID int64) {
+				defer recoverPanic(bot, chatID, lang, requestID)
+				exportUser(bot, collection, userID, chatID, lang)
+			}(update.UpdateID, userID, update.Message.Chat.ID)
+			return
+		case "import":
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "import_usage"))
+			bot.Send(msg)
+			return
+		case "export_all":
+			if !cfg.IsAdmin(userID) {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "admin_only"))
+				bot.Send(msg)
+				return
+			}
+			go func(requestID int, chatID int64) {
+				defer recoverPanic(bot, chatID, lang, requestID)
+				exportAll(bot, collection, cfg, chatID, lang)
+			}(update.UpdateID, update.Message.Chat.ID)
+			return
+		case "reset":
+			go func(requestID int, userID int64, chatID int64, lang string) {
+				defer recoverPanic(bot, chatID, lang, requestID)
+
+				mu := userLock(userID)
+				mu.Lock()
+				defer mu.Unlock()
+
+				prefs, err := getUserPrefs(collection, userID)
+				if err != nil {
+					sendError(bot, chatID, tr(lang, "prefs_error"))
+					return
+				}
+				if err := clearChatHistory(collection, userID, prefs.Session()); err != nil {
+					sendError(bot, chatID, tr(lang, "reset_error"))
+					return
+				}
+				resetDisclaimer(collection, userID)
+				reply := tr(lang, "reset_done")
+				if cfg.Stateless || prefs.Stateless || prefs.Private {
+					reply = tr(lang, "reset_stateless")
+				}
+				bot.Send(tgbotapi.NewMessage(chatID, reply))
+			}(update.UpdateID, userID, update.Message.Chat.ID, lang)
+			return
+		case "again":
+			reply, err := lastAssistantMessage(collection, userID, userPrefs.Session())
+			if err == mongo.ErrNoDocuments {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "again_none"))
+				bot.Send(msg)
+				return
+			}
+			if err != nil {
+				log.Printf("Failed to load last reply of user %d: %v", userID, err)
+				sendError(bot, update.Message.Chat.ID, tr(lang, "db_error"))
+				return
+			}
+			sendLongMessage(bot, update.Message.Chat.ID, brandReply(cfg, reply))
+			return
+		case "count":
+			user, assistant, err := countChatMessages(collection, userID, userPrefs.Session())
+			if err != nil {
+				sendError(bot, update.Message.Chat.ID, tr(lang, "db_error"))
+				return
+			}
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "count", userPrefs.Session(), user+assistant, user, assistant))
+			bot.Send(msg)
+			return
+		case "stateless":
+			parts := strings.Fields(text)
+			if len(parts) < 2 || (parts[1] != "on" && parts[1] != "off") {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "stateless_usage"))
+				bot.Send(msg)
+				return
+			}
+			if cfg.Stateless {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "stateless_global"))
+				bot.Send(msg)
+				return
+			}
+			var err error
+			if parts[1] == "on" {
+				err = setUserPref(collection, prefsID, "stateless", true)
+			} else {
+				err = unsetUserPref(collection, prefsID, "stateless")
+			}
+			if err != nil {
+				sendError(bot, update.Message.Chat.ID, tr(lang, "pref_error"))
+				return
+			}
+			reply := tr(lang, "stateless_off")
+			if parts[1] == "on" {
+				reply = tr(lang, "stateless_on")
+			}
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, reply)
+			bot.Send(msg)
+			return
+		case "private":
+			// Private mode is the user's own, even in a group with shared
+			// settings.
+			parts := strings.Fields(text)
+			if len(parts) < 2 || (parts[1] != "on" && parts[1] != "off") {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "private_usage"))
+				bot.Send(msg)
+				return
+			}
+			mu := userLock(userID)
+			mu.Lock()
+			var err error
+			if parts[1] == "on" {
+				if err = setUserPref(collection, userID, "private", true); err == nil {
+					err = clearAllChatHistory(collection, userID)
+				}
+			} else {
+				err = unsetUserPref(collection, userID, "private")
+			}
+			mu.Unlock()
+			if err != nil {
+				log.Printf("Failed to switch private mode of user %d: %v", userID, err)
+				sendError(bot, update.Message.Chat.ID, tr(lang, "pref_error"))
+				return
+			}
+			reply := tr(lang, "private_off")
+			if parts[1] == "on" {
+				reply = tr(lang, "private_on")
+			}
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, reply)
+			bot.Send(msg)
+			return
+		case "system":
+			prompt := strings.TrimSpace(update.Message.CommandArguments())
+			if prompt == "" {
+				reply := tr(lang, "system_usage")
+				if userPrefs.SystemPrompt != "" {
+					reply = tr(lang, "system_current", userPrefs.SystemPrompt) + "\n\n" + reply
+				}
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, reply)
+				bot.Send(msg)
+				return
+			}
+			if len([]rune(prompt)) > maxSystemPromptLen {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "system_too_long", maxSystemPromptLen))
+				bot.Send(msg)
+				return
+			}
+			var err error
+			reply := tr(lang, "system_set")
+			if prompt == "clear" {
+				err = unsetUserPref(collection, prefsID, "system_prompt")
+				reply = tr(lang, "system_cleared")
+			} else {
+				err = setUserPref(collection, prefsID, "system_prompt", prompt)
+			}
+			if err != nil {
+				sendError(bot, update.Message.Chat.ID, tr(lang, "pref_error"))
+				return
+			}
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, reply)
+			bot.Send(msg)
+			return
+		case "preset":
+			go func(requestID int, message *tgbotapi.Message) {
+				defer recoverPanic(bot, message.Chat.ID, lang, requestID)
+				handlePresetCommand(bot, collection, message, prefsID, lang)
+			}(update.UpdateID, update.Message)
+			return
+		case "footer":
+			parts := strings.Fields(text)
+			if len(parts) < 2 || (parts[1] != "on" && parts[1] != "off") {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "footer_usage"))
+				bot.Send(msg)
+				return
+			}
+			var err error
+			if parts[1] == "on" {
+				err = setUserPref(collection, prefsID, "footer", true)
+			} else {
+				err = unsetUserPref(collection, prefsID, "footer")
+			}
+			if err != nil {
+				sendError(bot, update.Message.Chat.ID, tr(lang, "pref_error"))
+				return
+			}
+			reply := tr(lang, "footer_off")
+			if parts[1] == "on" {
+				reply = tr(lang, "footer_on")
+			}
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, reply)
+			bot.Send(msg)
+			return
+		case "verbose":
+			parts := strings.Fields(text)
+			if len(parts) < 2 || (parts[1] != "on" && parts[1] != "off") {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "verbose_usage"))
+				bot.Send(msg)
+				return
+			}
+			var err error
+			if parts[1] == "on" {
+				err = setUserPref(collection, prefsID, "verbose", true)
+			} else {
+				err = unsetUserPref(collection, prefsID, "verbose")
+			}
+			if err != nil {
+				sendError(bot, update.Message.Chat.ID, tr(lang, "pref_error"))
+				return
+			}
+			reply := tr(lang, "verbose_off")
+			if parts[1] == "on" {
+				reply = tr(lang, "verbose_on")
+			}
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, reply)
+			bot.Send(msg)
+			return
+		case "lang":
+			parts := strings.Fields(text)
+			if len(parts) < 2 {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "lang_usage"))
+				bot.Send(msg)
+				return
+			}
+			choice := strings.ToLower(parts[1])
+			var reply string
+			if choice == "auto" {
+				err = unsetUserPref(collection, prefsID, "lang")
+				reply = tr(lang, "lang_auto")
+			} else if _, ok := catalog[choice]; ok {
+				err = setUserPref(collection, prefsID, "lang", choice)
+				reply = tr(choice, "lang_set")
+			} else {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "lang_usage"))
+				bot.Send(msg)
+				return
+			}
+			if err != nil {
+				sendError(bot, update.Message.Chat.ID, tr(lang, "pref_error"))
+				return
+			}
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, reply)
+			bot.Send(msg)
+			return
+		case "session":
+			go func(requestID int, message *tgbotapi.Message) {
+				defer recoverPanic(bot, message.Chat.ID, lang, requestID)
+				handleSessionCommand(bot, collection, cfg, message, lang)
+			}(update.UpdateID, update.Message)
+			return
 		}
 
-		go func(userID int64, chatID int64, text string) {
-			model, err := getUserModel(collection, userID)
-			if err != nil || model == "" {
-				model = "gpt-3.5-turbo"
+		// Only a command entity at the very start makes a message a
+		// command, so a "/" elsewhere in the text still goes to the model.
+		// Commands for other bots in a group are none of our business.
+		if update.Message.IsCommand() {
+			if _, addressee, ok := strings.Cut(update.Message.CommandWithAt(), "@"); !ok || strings.EqualFold(addressee, bot.Self.UserName) {
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "unknown_command", update.Message.Command()))
+				bot.Send(msg)
 			}
+			return
+		}
+
+		var urls []string
+		if cfg.FetchURLs {
+			urls = messageURLs(update.Message)
+		}
+		endRequest, ok := beginUserRequest(userID, cfg.MaxUserRequests)
+		if !ok {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(lang, "request_in_progress"))
+			bot.Send(msg)
+			return
+		}
+		chatHint := groupContextHint(cfg, update.Message)
+		sender := senderName(cfg, update.Message)
+		go func(requestID int, userID, prefsID int64, chatID int64, lang, chatHint, sender, text string, urls []string) {
+			defer recoverPanic(bot, chatID, lang, requestID)
+			defer endRequest()
+			received := time.Now()
+
+			mu := userLock(userID)
+			mu.Lock()
+			defer mu.Unlock()
 
-			// Load chat history
-			history, err := loadChatHistory(collection, userID)
+			if !allowInput(bot, userID, chatID, lang, text) {
+				return
+			}
+			if !checkDailyQuota(bot, collection, cfg, userID, chatID, lang) {
+				return
+			}
+
+			prefs, err := loadPrefs(collection, userID, prefsID)
 			if err != nil {
-				log.Printf("Failed to load chat history: %v", err)
+				log.Printf("Failed to load user prefs: %v", err)
+			}
+			model := budgetModel(bot, collection, cfg, userID, chatID, lang, requestModel(collection, cfg, prefsID, prefs))
+
+			showDisclaimer(bot, collection, cfg, prefs, userID, chatID)
+
+			// Load chat history unless the user runs without one. In
+			// private mode nothing the user writes is stored; only
+			// metadata such as usage and quota counts is.
+			session := prefs.Session()
+			stateless := cfg.Stateless || prefs.Stateless || prefs.Private
+			if !stateless && resetIfInactive(collection, cfg, userID, prefs) && cfg.InactivityNotice {
+				bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "inactivity_reset")))
+			}
+			var history []ChatMessage
+			if !stateless {
+				history, err = loadChatHistory(collection, userID, session, cfg.HistoryLoadLimit)
+				if err != nil {
+					log.Printf("Failed to load chat history: %v", err)
+				}
 			}
 
 			// Append user message to history
-			history = append(history, ChatMessage{
-				UserID:  userID,
-				Role:    "user",
-				Content: text,
+			userMsg := ChatMessage{
+				UserID:    userID,
+				Session:   session,
+				Role:      "user",
+				Content:   withSender(sender, text),
+				CreatedAt: time.Now(),
+			}
+			history = append(history, userMsg)
+
+			// Call OpenAI API, dropping the oldest messages if the history
+			// no longer fits into the model's context window.
+			ctx, cancel := requestContext(cfg, userID)
+			defer cancel()
+			stopNotice := notifyAfter(cfg.RequestSoftDeadline, func() {
+				bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "still_working")))
 			})
 
-			// Prepare messages for OpenAI
-			var messages []OpenAIMessage
-			for _, msg := range history {
-				messages = append(messages, OpenAIMessage{
-					Role:    msg.Role,
-					Content: msg.Content,
-				})
+			// Prepare messages for OpenAI. Only the outgoing copy of the
+			// new message is preprocessed; history keeps it as typed.
+			input, err := preprocess(withMessageURLs(ctx, urls), userID, userMsg.Content)
+			if err != nil {
+				stopNotice()
+				log.Printf("Failed to preprocess message: %v", err)
+				recordLastError(userID, requestID, "internal", err)
+				sendError(bot, chatID, tr(lang, "internal_error"))
+				return
 			}
+			history = compactHistory(ctx, collection, cfg, userID, session, model, history)
+			messages := withInput(buildMessages(cfg, prefs, lang, chatHint, history), input)
+			ph := sendPlaceholder(bot, chatID, cfg.PlaceholderText)
 
-			// Call OpenAI API
-			responseText, err := callOpenAI(cfg.OpenAIAPIKey, model, messages)
-			if err != nil {
-				msg := tgbotapi.NewMessage(chatID, "Ошибка при обращении к OpenAI API")
+			complete := func(req OpenAIRequest) (*OpenAIResponse, error) {
+				return callOpenAI(ctx, req)
+			}
+			// Variants can't be streamed: their deltas arrive interleaved.
+			var stream *streamMessage
+			if cfg.StreamResponses && prefs.Variants < 2 && !wantsAudio(cfg, model) {
+				stream = newStreamMessage(bot, chatID)
+				stream.usePlaceholder(ph)
+				complete = func(req OpenAIRequest) (*OpenAIResponse, error) {
+					started := false
+					return streamOpenAI(ctx, req, func(delta string) {
+						if !started {
+							started = true
+							stopNotice()
+							holdReply(received, cfg.ReplyMinDelay)
+							delta = brandReply(cfg, delta)
+						}
+						stream.Write(delta)
+					})
+				}
+			}
+			// The content filter fallback model is subject to the budget too.
+			request := func(model string) (*OpenAIResponse, error) {
+				model = budgetModel(bot, collection, cfg, userID, 0, lang, model)
+				return complete(buildRequest(cfg, userID, model, prefs, messages))
+			}
+			var resetStream func()
+			if stream != nil {
+				resetStream = stream.Reset
+			}
+			started := time.Now()
+			resp, err := withFilterFallback(cfg, model, request, resetStream)
+			truncated := false
+			for attempt := 0; attempt < maxContextRetries && isContextLengthError(err); attempt++ {
+				var ok bool
+				history, ok = dropOldestMessages(history)
+				if !ok {
+					break
+				}
+				truncated = true
+				messages = withInput(buildMessages(cfg, prefs, lang, chatHint, history), input)
+				resp, err = withFilterFallback(cfg, model, request, resetStream)
+			}
+			latency := time.Since(started)
+			stopNotice()
+			if truncated && err == nil {
+				msg := tgbotapi.NewMessage(chatID, tr(lang, "history_truncated"))
 				bot.Send(msg)
+			}
+			if err != nil {
+				log.Printf("OpenAI request failed: %v", err)
+				if stream != nil {
+					stream.Close()
+				}
+				ph.Delete()
+				recordOpenAIError(userID, requestID, err)
+				sendError(bot, chatID, openAIErrorText(lang, err))
 				return
 			}
+			responseText := resp.Choices[0].Message.Content
 
-			// Append assistant response to history
-			history = append(history, ChatMessage{
-				UserID:  userID,
-				Role:    "assistant",
-				Content: responseText,
-			})
+			// A farewell keyword ends the session once the reply is out;
+			// its history is about to go, so the turn is not saved.
+			if isEndKeyword(cfg.EndKeywords, text) {
+				defer endSession(bot, collection, userID, chatID, lang, session, stateless)
+				stateless = true
+			}
 
-			// Save updated history
-			err = saveChatHistory(collection, userID, history)
-			if err != nil {
-				log.Printf("Failed to save chat history: %v", err)
+			// Save the new turn; older messages are already stored
+			assistantAt := time.Now()
+			if !stateless {
+				assistantMsg := ChatMessage{
+					UserID:    userID,
+					Session:   session,
+					Role:      "assistant",
+					Content:   responseText,
+					CreatedAt: assistantAt,
+				}
+				err = appendChatMessages(collection, userID, session, userMsg, assistantMsg)
+				if err != nil {
+					log.Printf("Failed to save chat history, queuing a retry: %v", err)
+					enqueueSave(pendingSave{userID: userID, session: session, messages: []ChatMessage{userMsg, assistantMsg}})
+				} else if cfg.HistoryKeepMessages > 0 {
+					if _, err := trimSessionHistory(collection, userID, session, cfg.HistoryKeepMessages); err != nil {
+						log.Printf("Failed to trim chat history of user %d: %v", userID, err)
+					}
+				}
+				if err := touchSession(collection, userID, session); err != nil {
+					log.Printf("Failed to update last use of session %q: %v", session, err)
+				}
 			}
+			recordUsage(collection, userID, resp)
 
 			// Send response to user
-			msg := tgbotapi.NewMessage(chatID, responseText)
-			bot.Send(msg)
-		}(userID, update.Message.Chat.ID, text)
+			var footer string
+			if prefs.Footer {
+				footer += "\n\n" + usageFooter(lang, resp)
+			}
+			if prefs.Verbose {
+				footer += "\n\n" + diagnosticsFooter(resp, latency)
+			}
+			if prefs.Seed != nil && resp.SystemFingerprint != "" {
+				footer += fmt.Sprintf("\n\nsystem_fingerprint: %s", resp.SystemFingerprint)
+			}
+			if stream != nil {
+				stream.Write(footer)
+				stream.Close()
+				return
+			}
+			holdReply(received, cfg.ReplyMinDelay)
+			if len(resp.Choices) > 1 {
+				var variants []string
+				for i, choice := range resp.Choices {
+					variants = append(variants, choice.Message.Content)
+					text := tr(lang, "variant_header", i+1) + "\n\n" + brandReply(cfg, choice.Message.Content)
+					if i == len(resp.Choices)-1 {
+						text += footer
+					}
+					if i == 0 {
+						ph.Reply(text)
+					} else {
+						sendLongMessage(bot, chatID, text)
+					}
+				}
+				if !stateless {
+					rememberVariants(userID, &variantSet{id: requestID, session: session, storedAt: assistantAt, variants: variants})
+					msg := tgbotapi.NewMessage(chatID, tr(lang, "pick_prompt"))
+					msg.ReplyMarkup = pickKeyboard(requestID, len(variants))
+					bot.Send(msg)
+				}
+				return
+			}
+			ph.Reply(brandReply(cfg, responseText) + footer)
+			sendVoiceReply(bot, chatID, resp.Choices[0].Message)
+		}(update.UpdateID, userID, prefsID, update.Message.Chat.ID, lang, chatHint, sender, text, urls)
+	}
+
+	for update := range updates {
+		if cfg.UpdateDedupTTL > 0 && !claimUpdate(collection, update.UpdateID, cfg.UpdateDedupTTL) {
+			continue
+		}
+
+		if update.InlineQuery != nil {
+			if cfg.InlineEnabled && !maintenance.Load() {
+				go func(requestID int) {
+					defer recoverPanic(bot, 0, defaultLang, requestID)
+					handleInlineQuery(bot, collection, cfg, update.InlineQuery)
+				}(update.UpdateID)
+			}
+			continue
+		}
+
+		if update.CallbackQuery != nil {
+			if strings.HasPrefix(update.CallbackQuery.Data, pickCallbackPrefix) {
+				go func(requestID int) {
+					defer recoverPanic(bot, 0, defaultLang, requestID)
+					handlePickCallback(bot, collection, update.CallbackQuery)
+				}(update.UpdateID)
+			}
+			continue
+		}
+
+		if update.Message != nil {
+			chats.run(update.Message.Chat.ID, func() { handleMessage(update) })
+		}
 	}
 }
 
@@ -172,21 +1349,34 @@ func setUserModel(collection *mongo.Collection, userID int64, model string) erro
 	return err
 }
 
-func getUserModel(collection *mongo.Collection, userID int64) (string, error) {
+// deleteUserModel drops the user's /model choice so the default applies.
+func deleteUserModel(collection *mongo.Collection, userID int64) error {
 	filter := bson.M{"user_id": userID, "type": "model"}
+	_, err := collection.DeleteOne(context.TODO(), filter)
+	return err
+}
+
+func getUserModel(collection *mongo.Collection, userID int64) (string, error) {
 	var result struct {
 		Model string `bson:"model"`
 	}
-	err := collection.FindOne(context.TODO(), filter).Decode(&result)
+	err := findUserDoc(collection, userID, "model", &result)
 	if err != nil {
 		return "", err
 	}
 	return result.Model, nil
 }
 
-func loadChatHistory(collection *mongo.Collection, userID int64) ([]ChatMessage, error) {
-	filter := bson.M{"user_id": userID, "type": "chat"}
-	cursor, err := collection.Find(context.TODO(), filter)
+// loadChatHistory returns the most recent limit messages of a session in
+// chronological order; a zero limit loads everything. MongoDB does the
+// sorting and limiting, so long histories are never loaded in full.
+// Messages without a timestamp predate it and sort as the oldest.
+func loadChatHistory(collection *mongo.Collection, userID int64, session string, limit int) ([]ChatMessage, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cursor, err := collection.Find(context.TODO(), chatFilter(userID, session), opts)
 	if err != nil {
 		return nil, err
 	}
@@ -201,63 +1391,174 @@ func loadChatHistory(collection *mongo.Collection, userID int64) ([]ChatMessage,
 		}
 		history = append(history, msg)
 	}
+	slices.Reverse(history)
 	return history, nil
 }
 
-func saveChatHistory(collection *mongo.Collection, userID int64, history []ChatMessage) error {
-	// Remove old chat history for user
-	_, err := collection.DeleteMany(context.TODO(), bson.M{"user_id": userID, "type": "chat"})
-	if err != nil {
-		return err
+// maxStoredMessageBytes caps the content of a stored message so one huge
+// reply can't exceed MongoDB's 16 MB document limit and fail the save. Set
+// at startup from the config; 0 disables the cap.
+var maxStoredMessageBytes int
+
+// truncatedMarker ends a message cut by maxStoredMessageBytes.
+const truncatedMarker = "\n[truncated]"
+
+// capStoredContent cuts content to maxStoredMessageBytes on a UTF-8
+// boundary, reporting whether it had to.
+func capStoredContent(content string) (string, bool) {
+	limit := maxStoredMessageBytes - len(truncatedMarker)
+	if maxStoredMessageBytes <= 0 || len(content) <= maxStoredMessageBytes || limit <= 0 {
+		return content, false
 	}
+	for limit > 0 && !utf8.RuneStart(content[limit]) {
+		limit--
+	}
+	return content[:limit] + truncatedMarker, true
+}
 
-	// Insert updated history with type "chat"
+// appendChatMessages stores new messages of a session. Since history may
+// be loaded only partially, saving never rewrites what is already stored.
+func appendChatMessages(collection *mongo.Collection, userID int64, session string, messages ...ChatMessage) error {
+	// System prompts come only from preferences, so system messages never
+	// belong in the history.
 	var docs []interface{}
-	for _, msg := range history {
+	for _, msg := range messages {
+		if msg.Role == "system" {
+			log.Printf("Dropping system message from chat history of user %d", userID)
+			continue
+		}
+		content, truncated := capStoredContent(msg.Content)
+		if truncated {
+			log.Printf("Warning: truncated %s message of user %d from %d to %d bytes before saving", msg.Role, userID, len(msg.Content), len(content))
+		}
 		doc := bson.M{
-			"user_id": userID,
-			"role":    msg.Role,
-			"content": msg.Content,
-			"type":    "chat",
+			"user_id":    userID,
+			"session":    session,
+			"role":       msg.Role,
+			"content":    content,
+			"type":       "chat",
+			"created_at": msg.CreatedAt,
 		}
 		docs = append(docs, doc)
 	}
-	_, err = collection.InsertMany(context.TODO(), docs)
+	if len(docs) == 0 {
+		return nil
+	}
+	_, err := collection.InsertMany(context.TODO(), docs)
 	return err
 }
 
-func callOpenAI(apiKey, model string, messages []OpenAIMessage) (string, error) {
-	reqBody := OpenAIRequest{
-		Model:    model,
-		Messages: messages,
+// dropOldestMessages removes the older half of the history while keeping
+// the latest message (the pending user turn). It reports false when there
+// is nothing left to drop.
+func dropOldestMessages(history []ChatMessage) ([]ChatMessage, bool) {
+	older := len(history) - 1
+	if older <= 0 {
+		return history, false
+	}
+	drop := (older + 1) / 2
+	return history[drop:], true
+}
+
+// recoverPanic must be deferred at the top of every handler goroutine: it
+// logs a panic with the request (update) ID and tells the user something
+// went wrong instead of letting the panic take down the whole bot. A zero
+// chatID skips the user notification.
+func recoverPanic(bot *tgbotapi.BotAPI, chatID int64, lang string, requestID int) {
+	r := recover()
+	if r == nil {
+		return
 	}
+	log.Printf("[req %d] panic in handler: %v\n%s", requestID, r, debug.Stack())
+	if chatID != 0 {
+		sendError(bot, chatID, tr(lang, "internal_error"))
+	}
+}
+
+// requestFile turns a configured file reference into something Telegram
+// can send: URLs are fetched by Telegram, anything else is a file ID.
+func requestFile(ref string) tgbotapi.RequestFileData {
+	if strings.HasPrefix(ref, "http://") || strings.HasPrefix(ref, "https://") {
+		return tgbotapi.FileURL(ref)
+	}
+	return tgbotapi.FileID(ref)
+}
+
+func callOpenAI(ctx context.Context, reqBody OpenAIRequest) (*OpenAIResponse, error) {
+	if spendCapReached.Load() {
+		return nil, ErrSpendCap
+	}
+	reqBody = adaptRequest(reqBody)
+	ctx, span := startSpan(ctx, "openai.request", "gen_ai.request.model", reqBody.Model)
+	started := time.Now()
+	defer func() { observeTiming("openai.request", time.Since(started)) }()
+	resp, err := withRetries(ctx, nil, func() (*OpenAIResponse, error) {
+		return withBreaker(func() (*OpenAIResponse, error) {
+			apiKey := apiKeys.Pick()
+			resp, err := provider.Complete(ctx, apiKey, reqBody)
+			apiKeys.Report(apiKey, err)
+			if err == nil {
+				err = postprocessResponse(resp)
+			}
+			return resp, err
+		})
+	})
+	if err == nil {
+		err = checkContentFilter(resp)
+	}
+	span.End(err)
+	return resp, err
+}
+
+// withBreaker runs an OpenAI call through the circuit breaker.
+func withBreaker(call func() (*OpenAIResponse, error)) (*OpenAIResponse, error) {
+	if !openAIBreaker.Allow() {
+		metricBreakerRejections.Add(1)
+		return nil, errCircuitOpen
+	}
+	resp, err := call()
+	openAIBreaker.Record(isUpstreamFailure(err))
+	return resp, err
+}
+
+func doOpenAIRequest(ctx context.Context, apiKey string, reqBody OpenAIRequest) (*OpenAIResponse, error) {
 	jsonData, err := json.Marshal(reqBody)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", openAIAPIURL, bytes.NewBuffer(jsonData))
+	req, err := chatRequest(ctx, apiKey, reqBody.Model, jsonData)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := openAIClient.Do(req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	var openAIResp OpenAIResponse
 	err = json.NewDecoder(resp.Body).Decode(&openAIResp)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if openAIResp.Error != nil {
+		openAIResp.Error.StatusCode = resp.StatusCode
+		return nil, openAIResp.Error
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &APIError{StatusCode: resp.StatusCode, Message: "unexpected status " + resp.Status}
 	}
 
-	if len(openAIResp.Choices) > 0 {
-		return openAIResp.Choices[0].Message.Content, nil
+	if len(openAIResp.Choices) == 0 {
+		return nil, ErrEmptyResponse
+	}
+	// Spoken replies come without content; their text is the transcript.
+	for i, choice := range openAIResp.Choices {
+		if choice.Message.Content == "" && choice.Message.Audio != nil {
+			openAIResp.Choices[i].Message.Content = choice.Message.Audio.Transcript
+		}
 	}
-	return "", fmt.Errorf("no response from OpenAI")
+	return &openAIResp, nil
 }
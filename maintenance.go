@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maintenance is set while the bot is in maintenance mode: non-admins get
+// the maintenance notice and no OpenAI calls are made for them. The flag
+// is stored in the single {type: "bot_state"} document so it survives
+// restarts.
+var maintenance atomic.Bool
+
+var botStateFilter = bson.M{"type": "bot_state"}
+
+// loadMaintenance restores the stored maintenance flag.
+func loadMaintenance(collection *mongo.Collection) error {
+	var state struct {
+		Maintenance bool `bson:"maintenance"`
+	}
+	err := collection.FindOne(context.TODO(), botStateFilter).Decode(&state)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	maintenance.Store(state.Maintenance)
+	return nil
+}
+
+// setMaintenance stores the maintenance flag, then applies it.
+func setMaintenance(collection *mongo.Collection, on bool) error {
+	update := bson.M{"$set": bson.M{"maintenance": on}}
+	opts := options.Update().SetUpsert(true)
+	if _, err := collection.UpdateOne(context.TODO(), botStateFilter, update, opts); err != nil {
+		return err
+	}
+	maintenance.Store(on)
+	return nil
+}
+
+// maintenanceNotice is the reply to non-admins during maintenance: the
+// configured MAINTENANCE_MESSAGE, or the catalog's notice.
+func maintenanceNotice(custom, lang string) string {
+	if custom != "" {
+		return custom
+	}
+	return tr(lang, "maintenance_notice")
+}
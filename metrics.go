@@ -0,0 +1,61 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+
+	"ai_tg_bot/config"
+)
+
+// Metrics are published through expvar at /debug/vars on METRICS_ADDR.
+var (
+	metricBreakerRejections = expvar.NewInt("openai_breaker_rejections")
+	metricSavesDropped      = expvar.NewInt("history_saves_dropped")
+	metricFloodWaits        = expvar.NewInt("telegram_flood_waits")
+	metricThrottleWaits     = expvar.NewInt("openai_throttle_waits")
+
+	// metricRateLimitRemaining holds the requests and tokens OpenAI last
+	// reported left, as "<key>.requests" and "<key>.tokens" gauges.
+	metricRateLimitRemaining = expvar.NewMap("openai_ratelimit_remaining")
+)
+
+// setGauge sets the value published under key in m.
+func setGauge(m *expvar.Map, key string, value int) {
+	v := new(expvar.Int)
+	v.Set(int64(value))
+	m.Set(key, v)
+}
+
+func init() {
+	expvar.Publish("openai_breaker_state", expvar.Func(func() interface{} {
+		return openAIBreaker.State().String()
+	}))
+}
+
+// startMetricsExporter starts the exporter named by METRICS_EXPORTER.
+// Empty exports nothing beyond the expvar endpoint.
+func startMetricsExporter(cfg *config.Config) error {
+	switch cfg.MetricsExporter {
+	case "":
+		return nil
+	case "statsd":
+		return startStatsD(cfg.StatsDAddr, cfg.StatsDPrefix, cfg.StatsDInterval)
+	case "otlp":
+		return startOTLP(cfg.OTLPEndpoint, cfg.OTLPServiceName, cfg.OTLPHeaders, cfg.OTLPInterval)
+	}
+	return fmt.Errorf("unknown exporter %q, want \"statsd\" or \"otlp\"", cfg.MetricsExporter)
+}
+
+func startMetricsServer(addr string) {
+	if addr == "" {
+		return
+	}
+	go func() {
+		log.Printf("Serving metrics on %s/debug/vars", addr)
+		if err := http.ListenAndServe(addr, nil); err != nil {
+			log.Printf("Metrics server stopped: %v", err)
+		}
+	}()
+}
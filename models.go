@@ -0,0 +1,101 @@
+package main
+
+import "strings"
+
+// ModelInfo describes a model's limits, pricing and capabilities.
+type ModelInfo struct {
+	ContextWindow int     // tokens
+	MaxOutput     int     // most completion tokens the model produces per request
+	InputPrice    float64 // USD per 1M prompt tokens
+	OutputPrice   float64 // USD per 1M completion tokens
+	Vision        bool
+	Tools         bool
+	JSONMode      bool
+	Reasoning     bool // o-series: takes max_completion_tokens instead of max_tokens
+	AudioOutput   bool // can speak its reply (modalities text+audio)
+}
+
+// modelTable lists known models. Dated snapshots (e.g. gpt-4o-2024-08-06)
+// resolve to their base entry by prefix.
+var modelTable = map[string]ModelInfo{
+	"gpt-3.5-turbo":             {ContextWindow: 16385, MaxOutput: 4096, InputPrice: 0.50, OutputPrice: 1.50, Tools: true, JSONMode: true},
+	"gpt-4":                     {ContextWindow: 8192, MaxOutput: 8192, InputPrice: 30, OutputPrice: 60, Tools: true},
+	"gpt-4-turbo":               {ContextWindow: 128000, MaxOutput: 4096, InputPrice: 10, OutputPrice: 30, Vision: true, Tools: true, JSONMode: true},
+	"gpt-4o":                    {ContextWindow: 128000, MaxOutput: 16384, InputPrice: 2.50, OutputPrice: 10, Vision: true, Tools: true, JSONMode: true},
+	"gpt-4o-mini":               {ContextWindow: 128000, MaxOutput: 16384, InputPrice: 0.15, OutputPrice: 0.60, Vision: true, Tools: true, JSONMode: true},
+	"gpt-4.1":                   {ContextWindow: 1047576, MaxOutput: 32768, InputPrice: 2, OutputPrice: 8, Vision: true, Tools: true, JSONMode: true},
+	"gpt-4.1-mini":              {ContextWindow: 1047576, MaxOutput: 32768, InputPrice: 0.40, OutputPrice: 1.60, Vision: true, Tools: true, JSONMode: true},
+	"gpt-4.1-nano":              {ContextWindow: 1047576, MaxOutput: 32768, InputPrice: 0.10, OutputPrice: 0.40, Vision: true, Tools: true, JSONMode: true},
+	"gpt-4o-audio-preview":      {ContextWindow: 128000, MaxOutput: 16384, InputPrice: 2.50, OutputPrice: 10, Tools: true, AudioOutput: true},
+	"gpt-4o-mini-audio-preview": {ContextWindow: 128000, MaxOutput: 16384, InputPrice: 0.15, OutputPrice: 0.60, Tools: true, AudioOutput: true},
+	"o1":                        {ContextWindow: 200000, MaxOutput: 100000, InputPrice: 15, OutputPrice: 60, Vision: true, Tools: true, JSONMode: true, Reasoning: true},
+	"o1-mini":                   {ContextWindow: 128000, MaxOutput: 65536, InputPrice: 1.10, OutputPrice: 4.40, Reasoning: true},
+	"o3-mini":                   {ContextWindow: 200000, MaxOutput: 100000, InputPrice: 1.10, OutputPrice: 4.40, Tools: true, JSONMode: true, Reasoning: true},
+}
+
+// lookupModel finds model in the table, falling back to the longest known
+// name that model starts with.
+func lookupModel(model string) (ModelInfo, bool) {
+	if info, ok := modelTable[model]; ok {
+		return info, true
+	}
+	best := ""
+	for name := range modelTable {
+		if strings.HasPrefix(model, name+"-") && len(name) > len(best) {
+			best = name
+		}
+	}
+	if best == "" {
+		return ModelInfo{}, false
+	}
+	return modelTable[best], true
+}
+
+// adaptRequest drops the parameters req.Model is known to reject, so
+// that settings made for one model don't fail requests after a switch to
+// another. Reasoning models take no temperature, top_p or logit bias, and
+// take their output cap as max_completion_tokens; other models take no
+// reasoning effort and get the cap as max_tokens. JSON mode is dropped for
+// models without it. Requests for models missing from the table are sent
+// as they are.
+func adaptRequest(req OpenAIRequest) OpenAIRequest {
+	info, ok := lookupModel(req.Model)
+	if !ok {
+		return req
+	}
+	if info.Reasoning {
+		req.Temperature = nil
+		req.TopP = nil
+		req.LogitBias = nil
+		if req.MaxCompletionTokens == 0 {
+			req.MaxCompletionTokens = req.MaxTokens
+		}
+		req.MaxTokens = 0
+	} else {
+		req.ReasoningEffort = ""
+		if req.MaxTokens == 0 {
+			req.MaxTokens = req.MaxCompletionTokens
+		}
+		req.MaxCompletionTokens = 0
+	}
+	if !info.JSONMode && req.ResponseFormat != nil && req.ResponseFormat.Type == "json_object" {
+		req.ResponseFormat = nil
+	}
+	return req
+}
+
+// modelInfoText renders /model info for a model.
+func modelInfoText(lang, model string) string {
+	info, ok := lookupModel(model)
+	if !ok {
+		return tr(lang, "model_unknown", model)
+	}
+	yesNo := func(b bool) string {
+		if b {
+			return tr(lang, "yes")
+		}
+		return tr(lang, "no")
+	}
+	return tr(lang, "model_info", model, info.ContextWindow, info.InputPrice, info.OutputPrice,
+		yesNo(info.Vision), yesNo(info.Tools), yesNo(info.JSONMode))
+}
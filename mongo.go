@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+
+	"ai_tg_bot/config"
+)
+
+// clientOptions applies the configured pool size and timeouts on top of
+// the connection URI. Unset values keep the driver defaults.
+func clientOptions(cfg *config.Config) (*options.ClientOptions, error) {
+	opts := options.Client().ApplyURI(cfg.MongoURI)
+	opts.SetMonitor(&event.CommandMonitor{
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			observeTiming("mongo."+e.CommandName, e.Duration)
+			recordSpan(ctx, "mongo."+e.CommandName, e.Duration, nil, "db.system", "mongodb", "db.name", e.DatabaseName)
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			observeTiming("mongo."+e.CommandName+".failed", e.Duration)
+			recordSpan(ctx, "mongo."+e.CommandName, e.Duration, errors.New(e.Failure), "db.system", "mongodb", "db.name", e.DatabaseName)
+		},
+	})
+	if cfg.MongoMinPoolSize < 0 || cfg.MongoMaxPoolSize < 0 {
+		return nil, fmt.Errorf("MONGO_MIN_POOL_SIZE and MONGO_MAX_POOL_SIZE must not be negative")
+	}
+	if cfg.MongoMaxPoolSize > 0 {
+		if cfg.MongoMinPoolSize > cfg.MongoMaxPoolSize {
+			return nil, fmt.Errorf("MONGO_MIN_POOL_SIZE %d exceeds MONGO_MAX_POOL_SIZE %d", cfg.MongoMinPoolSize, cfg.MongoMaxPoolSize)
+		}
+		opts.SetMaxPoolSize(uint64(cfg.MongoMaxPoolSize))
+	}
+	if cfg.MongoMinPoolSize > 0 {
+		opts.SetMinPoolSize(uint64(cfg.MongoMinPoolSize))
+	}
+	if cfg.MongoMaxConnIdleTime > 0 {
+		opts.SetMaxConnIdleTime(cfg.MongoMaxConnIdleTime)
+	}
+	if cfg.MongoConnectTimeout > 0 {
+		opts.SetConnectTimeout(cfg.MongoConnectTimeout)
+	}
+	if cfg.MongoServerSelectionTimeout > 0 {
+		opts.SetServerSelectionTimeout(cfg.MongoServerSelectionTimeout)
+	}
+	return opts, nil
+}
+
+// collectionOptions applies the configured read and write concerns. With
+// both set to "majority" the bot reliably reads back the history it has
+// just saved on a replica set. Unset values keep the driver defaults.
+func collectionOptions(cfg *config.Config) (*options.CollectionOptions, error) {
+	opts := options.Collection()
+
+	switch cfg.MongoReadConcern {
+	case "":
+	case "local", "available", "majority", "linearizable":
+		opts.SetReadConcern(&readconcern.ReadConcern{Level: cfg.MongoReadConcern})
+	default:
+		return nil, fmt.Errorf("invalid MONGO_READ_CONCERN %q", cfg.MongoReadConcern)
+	}
+
+	switch cfg.MongoWriteConcern {
+	case "":
+	case "majority":
+		opts.SetWriteConcern(writeconcern.Majority())
+	default:
+		w, err := strconv.Atoi(cfg.MongoWriteConcern)
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("invalid MONGO_WRITE_CONCERN %q", cfg.MongoWriteConcern)
+		}
+		opts.SetWriteConcern(&writeconcern.WriteConcern{W: w})
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"ai_tg_bot/config"
+)
+
+// answerOneShot sends a single request outside the chat: no history is
+// loaded and nothing is stored, but the quota and usage still count.
+func answerOneShot(bot *tgbotapi.BotAPI, collection *mongo.Collection, cfg *config.Config, requestID int, userID, chatID int64, lang string, req OpenAIRequest) {
+	var input []string
+	for _, msg := range req.Messages {
+		if msg.Role == "user" {
+			input = append(input, msg.Content)
+		}
+	}
+	if !allowInput(bot, userID, chatID, lang, input...) {
+		return
+	}
+
+	mu := userLock(userID)
+	mu.Lock()
+	allowed := checkDailyQuota(bot, collection, cfg, userID, chatID, lang)
+	mu.Unlock()
+	if !allowed {
+		return
+	}
+	req.Model = budgetModel(bot, collection, cfg, userID, chatID, lang, req.Model)
+
+	ctx, cancel := requestContext(cfg, userID)
+	defer cancel()
+	stopNotice := notifyAfter(cfg.RequestSoftDeadline, func() {
+		bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "still_working")))
+	})
+	resp, err := callOpenAI(ctx, req)
+	stopNotice()
+	if err != nil {
+		recordOpenAIError(userID, requestID, err)
+		sendError(bot, chatID, openAIErrorText(lang, err))
+		return
+	}
+	recordUsage(collection, userID, resp)
+
+	sendLongMessage(bot, chatID, brandReply(cfg, resp.Choices[0].Message.Content))
+}
+
+// buildThinkRequest routes a /think prompt to the reasoning model. Neither
+// the user's nor the default parameters apply; only the output cap and
+// effort set for /think are sent, adapted by adaptRequest if THINK_MODEL
+// is not a reasoning model.
+func buildThinkRequest(cfg *config.Config, userID int64, prompt string) OpenAIRequest {
+	return OpenAIRequest{
+		Model:               cfg.ThinkModel,
+		Messages:            []OpenAIMessage{{Role: "user", Content: prompt}},
+		User:                hashUserID(cfg.UserHashSalt, userID),
+		ReasoningEffort:     cfg.ThinkReasoningEffort,
+		MaxCompletionTokens: cfg.ThinkMaxTokens,
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// otlpMaxSpans bounds the spans buffered between two flushes; spans past
+// it are dropped.
+const otlpMaxSpans = 2048
+
+// otlpTimingBounds are the histogram bucket bounds of timings, in
+// milliseconds.
+var otlpTimingBounds = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000}
+
+// otlpExporter pushes the expvar counters as cumulative sums, the timings
+// observeTiming reports as histograms, and the spans of OpenAI and MongoDB
+// calls to an OpenTelemetry collector, using OTLP over HTTP with the JSON
+// encoding.
+type otlpExporter struct {
+	endpoint string // base URL, e.g. http://localhost:4318
+	headers  map[string]string
+	resource otlpResource
+	started  time.Time
+	client   *http.Client
+
+	mu      sync.Mutex
+	spans   []otlpSpan
+	dropped int
+	timings map[string]*otlpHistogram
+}
+
+// otlpHistogram accumulates the timings of one operation since startup.
+type otlpHistogram struct {
+	count   uint64
+	sum     float64 // milliseconds
+	buckets []uint64
+}
+
+// otlp is the active exporter, nil unless METRICS_EXPORTER=otlp.
+var otlp atomic.Pointer[otlpExporter]
+
+func startOTLP(endpoint, service string, headers map[string]string, interval time.Duration) error {
+	if endpoint == "" {
+		return fmt.Errorf("OTLP_ENDPOINT must be set")
+	}
+	if interval <= 0 {
+		return fmt.Errorf("OTLP_INTERVAL must be positive")
+	}
+	e := &otlpExporter{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		headers:  headers,
+		resource: otlpResource{Attributes: []otlpAttribute{stringAttribute("service.name", service)}},
+		started:  time.Now(),
+		client:   &http.Client{Timeout: interval},
+		timings:  make(map[string]*otlpHistogram),
+	}
+	otlp.Store(e)
+	go func() {
+		for range time.Tick(interval) {
+			e.flush()
+		}
+	}()
+	log.Printf("Exporting metrics and traces over OTLP to %s", e.endpoint)
+	return nil
+}
+
+// span is an operation being traced. A nil *span, returned while OTLP is
+// off, ignores End.
+type span struct {
+	traceID, spanID, parentID string
+	name                      string
+	start                     time.Time
+	attrs                     []otlpAttribute
+}
+
+type spanKey struct{}
+
+// startSpan starts a span named name, a child of the span in ctx if there
+// is one. attrs are key, value pairs.
+func startSpan(ctx context.Context, name string, attrs ...string) (context.Context, *span) {
+	if otlp.Load() == nil {
+		return ctx, nil
+	}
+	s := &span{spanID: randomHex(8), name: name, start: time.Now()}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else {
+		s.traceID = randomHex(16)
+	}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.attrs = append(s.attrs, stringAttribute(attrs[i], attrs[i+1]))
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// End finishes the span, marking it failed if err is not nil.
+func (s *span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.finish(time.Now(), err)
+}
+
+func (s *span) finish(end time.Time, err error) {
+	e := otlp.Load()
+	if e == nil {
+		return
+	}
+	out := otlpSpan{
+		TraceID:      s.traceID,
+		SpanID:       s.spanID,
+		ParentSpanID: s.parentID,
+		Name:         s.name,
+		Kind:         otlpSpanKindClient,
+		Start:        strconv.FormatInt(s.start.UnixNano(), 10),
+		End:          strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:   s.attrs,
+	}
+	if err != nil {
+		out.Status = &otlpStatus{Code: otlpStatusError, Message: err.Error()}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.spans) >= otlpMaxSpans {
+		e.dropped++
+		return
+	}
+	e.spans = append(e.spans, out)
+}
+
+// observe adds a timing of the operation name to its histogram.
+func (e *otlpExporter) observe(name string, d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	h, ok := e.timings[name]
+	if !ok {
+		h = &otlpHistogram{buckets: make([]uint64, len(otlpTimingBounds)+1)}
+		e.timings[name] = h
+	}
+	h.count++
+	h.sum += ms
+	h.buckets[sort.SearchFloat64s(otlpTimingBounds, ms)]++
+}
+
+// recordSpan traces an operation that already ended, such as a MongoDB
+// command reported by the driver's monitor.
+func recordSpan(ctx context.Context, name string, d time.Duration, err error, attrs ...string) {
+	_, s := startSpan(ctx, name, attrs...)
+	if s == nil {
+		return
+	}
+	end := time.Now()
+	s.start = end.Add(-d)
+	s.finish(end, err)
+}
+
+// flush sends the counters and the buffered spans. Failures are logged
+// and the data is dropped; counters are cumulative, so the next flush
+// catches up.
+func (e *otlpExporter) flush() {
+	e.mu.Lock()
+	spans, dropped := e.spans, e.dropped
+	e.spans, e.dropped = nil, 0
+	timings := make(map[string]otlpHistogram, len(e.timings))
+	for name, h := range e.timings {
+		timings[name] = otlpHistogram{count: h.count, sum: h.sum, buckets: slices.Clone(h.buckets)}
+	}
+	e.mu.Unlock()
+	if dropped > 0 {
+		log.Printf("Warning: dropped %d spans over the OTLP buffer limit", dropped)
+	}
+
+	scope := otlpScope{Name: "ai_tg_bot"}
+	if len(spans) > 0 {
+		e.post("/v1/traces", map[string]interface{}{
+			"resourceSpans": []interface{}{map[string]interface{}{
+				"resource":   e.resource,
+				"scopeSpans": []interface{}{map[string]interface{}{"scope": scope, "spans": spans}},
+			}},
+		})
+	}
+
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	start := strconv.FormatInt(e.started.UnixNano(), 10)
+	var metrics []interface{}
+	expvar.Do(func(kv expvar.KeyValue) {
+		v, ok := kv.Value.(*expvar.Int)
+		if !ok {
+			return
+		}
+		metrics = append(metrics, map[string]interface{}{
+			"name": kv.Key,
+			"sum": map[string]interface{}{
+				"aggregationTemporality": otlpTemporalityCumulative,
+				"isMonotonic":            true,
+				"dataPoints": []interface{}{map[string]interface{}{
+					"startTimeUnixNano": start,
+					"timeUnixNano":      now,
+					"asInt":             strconv.FormatInt(v.Value(), 10),
+				}},
+			},
+		})
+	})
+	for name, h := range timings {
+		buckets := make([]string, len(h.buckets))
+		for i, n := range h.buckets {
+			buckets[i] = strconv.FormatUint(n, 10)
+		}
+		metrics = append(metrics, map[string]interface{}{
+			"name": name,
+			"unit": "ms",
+			"histogram": map[string]interface{}{
+				"aggregationTemporality": otlpTemporalityCumulative,
+				"dataPoints": []interface{}{map[string]interface{}{
+					"startTimeUnixNano": start,
+					"timeUnixNano":      now,
+					"count":             strconv.FormatUint(h.count, 10),
+					"sum":               h.sum,
+					"bucketCounts":      buckets,
+					"explicitBounds":    otlpTimingBounds,
+				}},
+			},
+		})
+	}
+	e.post("/v1/metrics", map[string]interface{}{
+		"resourceMetrics": []interface{}{map[string]interface{}{
+			"resource":     e.resource,
+			"scopeMetrics": []interface{}{map[string]interface{}{"scope": scope, "metrics": metrics}},
+		}},
+	})
+}
+
+func (e *otlpExporter) post(path string, payload interface{}) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to encode OTLP export: %v", err)
+		return
+	}
+	req, err := http.NewRequest("POST", e.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to build OTLP export: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		log.Printf("Failed to export to %s: %v", path, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("Failed to export to %s: unexpected status %s", path, resp.Status)
+	}
+}
+
+// OTLP JSON encoding; see opentelemetry-proto. IDs are hex, and 64-bit
+// integers are decimal strings.
+const (
+	otlpSpanKindClient        = 3
+	otlpStatusError           = 2
+	otlpTemporalityCumulative = 2
+)
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	a.Value.StringValue = value
+	return a
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       *otlpStatus     `json:"status,omitempty"`
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
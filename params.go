@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"ai_tg_bot/config"
+)
+
+// paramsText renders /params: the parameters a chat message would be sent
+// with, built by buildRequest and adapted to the model the same way.
+// Values that come from MODEL_DEFAULTS rather than the global defaults are
+// marked as such.
+func paramsText(cfg *config.Config, lang, model string, userID int64, prefs UserPrefs) string {
+	req := adaptRequest(buildRequest(cfg, userID, model, prefs, nil))
+	override, hasOverride := cfg.ModelDefaults[model]
+	_, hasPreset := lengthPresets[prefs.Length]
+	notSet := tr(lang, "params_not_set")
+	fromModel := " " + tr(lang, "params_model_override")
+
+	var b strings.Builder
+	b.WriteString(tr(lang, "params_header"))
+	line := func(name, value string) {
+		fmt.Fprintf(&b, "\n%s: %s", name, value)
+	}
+	line("model", model)
+
+	temperature := notSet
+	switch {
+	case req.Temperature == nil:
+	case cfg.ParamsFor(model).Temperature == nil:
+		// Drawn from TEMPERATURE_RANGE anew for every request.
+		temperature = tr(lang, "params_random", cfg.TemperatureRange.Min, cfg.TemperatureRange.Max)
+	default:
+		temperature = fmt.Sprintf("%g", *req.Temperature)
+		if hasOverride && override.Temperature != nil {
+			temperature += fromModel
+		}
+	}
+	line("temperature", temperature)
+
+	name, maxTokens := "max_tokens", req.MaxTokens
+	if req.MaxCompletionTokens > 0 {
+		name, maxTokens = "max_completion_tokens", req.MaxCompletionTokens
+	}
+	switch {
+	case cfg.AutoMaxTokens && cfg.ParamsFor(model).MaxTokens == 0 && !hasPreset && fitMaxTokens(model, nil) > 0:
+		// Fitted to the remaining context window of every request. Models
+		// fitMaxTokens knows nothing about, or can't limit, stay unset.
+		line(name, tr(lang, "params_auto"))
+	case maxTokens > 0:
+		value := fmt.Sprint(maxTokens)
+		if hasOverride && override.MaxTokens > 0 && !hasPreset {
+			value += fromModel
+		}
+		line(name, value)
+	default:
+		line(name, notSet)
+	}
+
+	topP := notSet
+	if req.TopP != nil {
+		topP = fmt.Sprintf("%g", *req.TopP)
+	}
+	line("top_p", topP)
+	if req.Seed != nil {
+		line("seed", fmt.Sprint(*req.Seed))
+	}
+	if req.N != nil {
+		line("n", fmt.Sprint(*req.N))
+	}
+	if req.ResponseFormat != nil {
+		line("response_format", req.ResponseFormat.Type)
+	}
+	if req.ReasoningEffort != "" {
+		line("reasoning_effort", req.ReasoningEffort)
+	}
+
+	prompt := tr(lang, "params_prompt_none")
+	if prefs.SystemPrompt != "" {
+		prompt = tr(lang, "params_prompt_custom")
+	} else if defaultSystemPrompt() != "" {
+		prompt = tr(lang, "params_prompt_default")
+	}
+	line(tr(lang, "params_system_prompt"), prompt)
+	return b.String()
+}
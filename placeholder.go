@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// placeholder is a message shown while a reply is being prepared, which
+// is then edited into the reply. Without one (messageID 0) replies are
+// sent as new messages.
+type placeholder struct {
+	bot       *tgbotapi.BotAPI
+	chatID    int64
+	messageID int
+}
+
+// sendPlaceholder shows text in the chat, unless text is empty.
+func sendPlaceholder(bot *tgbotapi.BotAPI, chatID int64, text string) *placeholder {
+	p := &placeholder{bot: bot, chatID: chatID}
+	if text == "" {
+		return p
+	}
+	sent, err := bot.Send(tgbotapi.NewMessage(chatID, text))
+	if err != nil {
+		log.Printf("Failed to send placeholder: %v", err)
+		return p
+	}
+	p.messageID = sent.MessageID
+	return p
+}
+
+// Reply replaces the placeholder with the first part of text and sends
+// the rest as new messages.
+func (p *placeholder) Reply(text string) {
+	if p.messageID == 0 {
+		sendLongMessage(p.bot, p.chatID, text)
+		return
+	}
+	parts := splitMessage(text)
+	edit := tgbotapi.NewEditMessageText(p.chatID, p.messageID, parts[0])
+	if _, err := p.bot.Send(edit); err != nil {
+		if isEditTargetMissing(err) {
+			p.messageID = 0
+		} else {
+			log.Printf("Failed to edit placeholder, sending the reply anew: %v", err)
+			p.Delete()
+		}
+		sendLongMessage(p.bot, p.chatID, text)
+		return
+	}
+	p.messageID = 0
+	for _, part := range parts[1:] {
+		sendLongMessage(p.bot, p.chatID, part)
+	}
+}
+
+// Delete removes the placeholder, e.g. before an error message is sent.
+func (p *placeholder) Delete() {
+	if p.messageID == 0 {
+		return
+	}
+	if _, err := p.bot.Request(tgbotapi.NewDeleteMessage(p.chatID, p.messageID)); err != nil {
+		log.Printf("Failed to delete placeholder: %v", err)
+	}
+	p.messageID = 0
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// PostProcessor transforms the text of a reply before it is sent to the
+// user and stored in history.
+type PostProcessor func(text string) string
+
+// postProcessors run in registration order, each on the previous output.
+var postProcessors []PostProcessor
+
+// registerPostProcessor appends p to the chain. Processors are registered
+// at startup, before updates are handled.
+func registerPostProcessor(p PostProcessor) {
+	postProcessors = append(postProcessors, p)
+}
+
+func postprocess(text string) string {
+	for _, p := range postProcessors {
+		text = p(text)
+	}
+	return text
+}
+
+// postprocessResponse runs every choice of resp through the chain. A reply
+// with nothing left, e.g. one cut off while still reasoning, counts as
+// empty.
+func postprocessResponse(resp *OpenAIResponse) error {
+	if len(postProcessors) == 0 {
+		return nil
+	}
+	for i := range resp.Choices {
+		content := postprocess(resp.Choices[i].Message.Content)
+		if strings.TrimSpace(content) == "" {
+			return ErrEmptyResponse
+		}
+		resp.Choices[i].Message.Content = content
+	}
+	return nil
+}
+
+// maxHeldTagLen bounds how much of a possible tag is held back while
+// streaming; a longer run after '<' is plain text.
+const maxHeldTagLen = 64
+
+// postprocessedStream passes the post-processed text of a streamed reply
+// on as deltas. After every delta the whole reply so far is processed and
+// only what extends the text already passed on is emitted, so a processor
+// that removes a block withholds it from the first character. A trailing
+// '<' that might open a tag is held back until the tag is complete.
+type postprocessedStream struct {
+	onDelta func(string)
+	raw     strings.Builder
+	emitted string
+}
+
+func newPostprocessedStream(onDelta func(string)) *postprocessedStream {
+	return &postprocessedStream{onDelta: onDelta}
+}
+
+func (p *postprocessedStream) Write(delta string) {
+	p.raw.WriteString(delta)
+	text := p.raw.String()
+	if i := strings.LastIndexByte(text, '<'); i >= 0 && len(text)-i <= maxHeldTagLen && !strings.Contains(text[i:], ">") {
+		text = text[:i]
+	}
+	// A reply that opens with a quote may turn out to be wrapped in it;
+	// that is only known once text follows the closing quote.
+	if holdOpeningQuote && mayBeQuoted(text) {
+		return
+	}
+	p.emit(postprocess(text))
+}
+
+// Flush passes on whatever was held back once the reply is complete.
+func (p *postprocessedStream) Flush() {
+	p.emit(postprocess(p.raw.String()))
+}
+
+func (p *postprocessedStream) emit(text string) {
+	if rest, ok := strings.CutPrefix(text, p.emitted); ok && rest != "" {
+		p.emitted = text
+		p.onDelta(rest)
+	}
+}
+
+// trimSpace removes leading and trailing whitespace, such as the blank
+// lines some models start their replies with.
+func trimSpace(text string) string {
+	return strings.TrimSpace(text)
+}
+
+// wrappingQuotes maps opening quotation marks to their closing ones.
+var wrappingQuotes = map[rune]rune{'"': '"', '\'': '\'', '“': '”', '«': '»', '„': '“'}
+
+// holdOpeningQuote is set when quote stripping is on, so that streamed
+// replies hold back an opening quote until it is known not to wrap the
+// whole reply.
+var holdOpeningQuote bool
+
+// stripWrappingQuotes removes a pair of quotation marks around the whole
+// reply, as in "Hello!", leaving replies that merely start or end with a
+// quote, such as "Go" is a language, untouched.
+func stripWrappingQuotes(text string) string {
+	trimmed := strings.TrimSpace(text)
+	open, size := utf8.DecodeRuneInString(trimmed)
+	closing, ok := wrappingQuotes[open]
+	if !ok {
+		return text
+	}
+	inner := trimmed[size:]
+	last, lastSize := utf8.DecodeLastRuneInString(inner)
+	if last != closing || len(inner) == lastSize {
+		return text
+	}
+	inner = inner[:len(inner)-lastSize]
+	if strings.ContainsRune(inner, closing) {
+		return text
+	}
+	return strings.TrimSpace(inner)
+}
+
+// mayBeQuoted reports whether text starts with an opening quote that is
+// either not closed yet or closed by its last character, so that what
+// follows still decides whether the quotes wrap the whole reply.
+func mayBeQuoted(text string) bool {
+	trimmed := strings.TrimSpace(text)
+	open, size := utf8.DecodeRuneInString(trimmed)
+	closing, ok := wrappingQuotes[open]
+	if !ok {
+		return false
+	}
+	i := strings.IndexRune(trimmed[size:], closing)
+	return i < 0 || size+i+utf8.RuneLen(closing) == len(trimmed)
+}
+
+var tagNamePattern = regexp.MustCompile(`^[\w:-]+$`)
+
+// tagStripper removes <tag>...</tag> blocks of the given tags, such as the
+// <thinking> of reasoning-style models. A block that is never closed runs
+// to the end of the reply.
+func tagStripper(tags []string) (PostProcessor, error) {
+	var alternatives []string
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if !tagNamePattern.MatchString(tag) {
+			return nil, fmt.Errorf("invalid tag name %q", tag)
+		}
+		alternatives = append(alternatives, fmt.Sprintf(`<%s(?:\s[^>]*)?>.*?(?:</%s\s*>|\z)`, tag, tag))
+	}
+	pattern := regexp.MustCompile(`(?is)` + strings.Join(alternatives, "|"))
+	return func(text string) string {
+		stripped := pattern.ReplaceAllString(text, "")
+		if stripped == text {
+			return text
+		}
+		// Drop the blank lines a leading block leaves behind.
+		return strings.TrimLeft(stripped, " \t\r\n")
+	}, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// UserPrefs holds per-user settings stored in a single {type: "prefs"}
+// document. Zero values mean "not set".
+type UserPrefs struct {
+	Length   string `bson:"length,omitempty"` // "short", "medium" or "long"
+	JSONMode bool   `bson:"json_mode,omitempty"`
+	Seed     *int   `bson:"seed,omitempty"`
+
+	TopP *float64 `bson:"top_p,omitempty"` // nucleus sampling, 0-1
+
+	Stateless bool `bson:"stateless,omitempty"`
+	Private   bool `bson:"private,omitempty"` // like Stateless, and stored history was removed
+	Footer    bool `bson:"footer,omitempty"`  // show model and cost under replies
+	Verbose   bool `bson:"verbose,omitempty"` // show tokens, latency and finish reason under replies
+
+	Lang string `bson:"lang,omitempty"` // explicit /lang choice; empty means auto-detect
+
+	SystemPrompt string `bson:"system_prompt,omitempty"` // set with /system or /preset use
+
+	Variants int `bson:"variants,omitempty"` // answers per message, up to maxVariants
+
+	ActiveSession string    `bson:"active_session,omitempty"`
+	LastActive    time.Time `bson:"last_active,omitempty"` // last chat message, kept with INACTIVITY_RESET on
+
+	DisclaimerShown bool `bson:"disclaimer_shown,omitempty"` // cleared on /reset and session changes
+
+	Tier string `bson:"tier,omitempty"` // set by admins with /tier; empty means DEFAULT_TIER
+}
+
+func getUserPrefs(collection *mongo.Collection, userID int64) (UserPrefs, error) {
+	var prefs UserPrefs
+	err := findUserDoc(collection, userID, "prefs", &prefs)
+	if err == mongo.ErrNoDocuments {
+		return prefs, nil
+	}
+	return prefs, err
+}
+
+// findUserDoc decodes the user's document of docType into out. A document
+// that doesn't fully decode (a field of the wrong type, say) is not an
+// error: the fields that do decode are kept, the broken ones are left at
+// their defaults and removed from the stored document.
+func findUserDoc(collection *mongo.Collection, userID int64, docType string, out interface{}) error {
+	filter := bson.M{"user_id": userID, "type": docType}
+	raw, err := collection.FindOne(context.TODO(), filter).Raw()
+	if err != nil {
+		return err
+	}
+	if err := bson.Unmarshal(raw, out); err == nil {
+		return nil
+	}
+
+	elems, err := raw.Elements()
+	if err != nil {
+		log.Printf("Corrupt %s document of user %d, using defaults: %v", docType, userID, err)
+		return nil
+	}
+	broken := bson.M{}
+	for _, e := range elems {
+		field, err := bson.Marshal(bson.D{{Key: e.Key(), Value: e.Value()}})
+		if err == nil {
+			err = bson.Unmarshal(field, out)
+		}
+		if err != nil {
+			log.Printf("Dropping invalid field %q from %s document of user %d: %v", e.Key(), docType, userID, err)
+			broken[e.Key()] = ""
+		}
+	}
+	if len(broken) > 0 {
+		if _, err := collection.UpdateOne(context.TODO(), filter, bson.M{"$unset": broken}); err != nil {
+			log.Printf("Failed to repair %s document of user %d: %v", docType, userID, err)
+		}
+	}
+	return nil
+}
+
+func setUserPref(collection *mongo.Collection, userID int64, key string, value interface{}) error {
+	filter := bson.M{"user_id": userID, "type": "prefs"}
+	update := bson.M{"$set": bson.M{key: value}}
+	opts := options.Update().SetUpsert(true)
+	_, err := collection.UpdateOne(context.TODO(), filter, update, opts)
+	return err
+}
+
+func unsetUserPref(collection *mongo.Collection, userID int64, key string) error {
+	filter := bson.M{"user_id": userID, "type": "prefs"}
+	update := bson.M{"$unset": bson.M{key: ""}}
+	_, err := collection.UpdateOne(context.TODO(), filter, update)
+	return err
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"text/template"
+)
+
+// PreProcessor transforms the text of an incoming message before it is
+// sent to OpenAI. The stored history always keeps the text as typed.
+type PreProcessor func(ctx context.Context, userID int64, text string) (string, error)
+
+// preProcessors run in registration order, each on the previous output.
+var preProcessors []PreProcessor
+
+// registerPreProcessor appends p to the chain. Processors are registered
+// at startup, before updates are handled.
+func registerPreProcessor(p PreProcessor) {
+	preProcessors = append(preProcessors, p)
+}
+
+// preprocess runs text through the chain, stopping at the first error.
+func preprocess(ctx context.Context, userID int64, text string) (string, error) {
+	for _, p := range preProcessors {
+		var err error
+		text, err = p(ctx, userID, text)
+		if err != nil {
+			return "", err
+		}
+	}
+	return text, nil
+}
+
+type messageURLsKey struct{}
+
+// withMessageURLs attaches the links found in a message's entities to ctx
+// for processors that need them.
+func withMessageURLs(ctx context.Context, urls []string) context.Context {
+	return context.WithValue(ctx, messageURLsKey{}, urls)
+}
+
+func messageURLsFrom(ctx context.Context) []string {
+	urls, _ := ctx.Value(messageURLsKey{}).([]string)
+	return urls
+}
+
+// linkedPagesProcessor appends the text of pages linked in the message,
+// each cut to maxChars characters.
+func linkedPagesProcessor(maxChars int) PreProcessor {
+	return func(ctx context.Context, userID int64, text string) (string, error) {
+		pages := fetchLinkedPages(ctx, messageURLsFrom(ctx), maxChars)
+		if len(pages) == 0 {
+			return text, nil
+		}
+		return text + "\n\n" + strings.Join(pages, "\n\n"), nil
+	}
+}
+
+// promptInput is the data passed to the prompt template.
+type promptInput struct {
+	Input string
+}
+
+func parsePromptTemplate(text string) (*template.Template, error) {
+	return template.New("prompt").Option("missingkey=error").Parse(text)
+}
+
+// promptTemplateProcessor wraps the message in an operator-defined
+// template, with the message text as {{.Input}}.
+func promptTemplateProcessor(tmpl *template.Template) PreProcessor {
+	return func(ctx context.Context, userID int64, text string) (string, error) {
+		var b strings.Builder
+		if err := tmpl.Execute(&b, promptInput{Input: text}); err != nil {
+			return "", err
+		}
+		return b.String(), nil
+	}
+}
+
+// withInput replaces the content of the latest message, the pending user
+// turn, with its preprocessed text.
+func withInput(messages []OpenAIMessage, input string) []OpenAIMessage {
+	if len(messages) == 0 {
+		return messages
+	}
+	messages[len(messages)-1].Content = input
+	return messages
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxSystemPromptLen = 4000
+	maxPresetNameLen   = 32
+)
+
+// savePreset stores a named system prompt in a {type: "preset"} document,
+// replacing a preset of the same name.
+func savePreset(collection *mongo.Collection, userID int64, name, prompt string) error {
+	filter := bson.M{"user_id": userID, "type": "preset", "name": name}
+	update := bson.M{"$set": bson.M{"prompt": prompt}}
+	opts := options.Update().SetUpsert(true)
+	_, err := collection.UpdateOne(context.TODO(), filter, update, opts)
+	return err
+}
+
+// getPreset returns the prompt of a preset; ok is false if it doesn't exist.
+func getPreset(collection *mongo.Collection, userID int64, name string) (prompt string, ok bool, err error) {
+	filter := bson.M{"user_id": userID, "type": "preset", "name": name}
+	var doc struct {
+		Prompt string `bson:"prompt"`
+	}
+	err = collection.FindOne(context.TODO(), filter).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return doc.Prompt, true, nil
+}
+
+func listPresets(collection *mongo.Collection, userID int64) ([]string, error) {
+	filter := bson.M{"user_id": userID, "type": "preset"}
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+	cursor, err := collection.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	var names []string
+	for cursor.Next(context.TODO()) {
+		var doc struct {
+			Name string `bson:"name"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		names = append(names, doc.Name)
+	}
+	return names, cursor.Err()
+}
+
+// deletePreset removes a preset and reports whether it existed.
+func deletePreset(collection *mongo.Collection, userID int64, name string) (bool, error) {
+	res, err := collection.DeleteOne(context.TODO(), bson.M{"user_id": userID, "type": "preset", "name": name})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+// handlePresetCommand implements /preset save|use|list|delete. Presets are
+// named system prompts; /preset save <name> stores the active system
+// prompt, or the text after the name if given.
+func handlePresetCommand(bot *tgbotapi.BotAPI, collection *mongo.Collection, message *tgbotapi.Message, prefsID int64, lang string) {
+	chatID := message.Chat.ID
+	userID := message.From.ID
+	reply := func(text string) {
+		bot.Send(tgbotapi.NewMessage(chatID, text))
+	}
+
+	args := strings.Fields(message.CommandArguments())
+	if len(args) == 0 {
+		reply(tr(lang, "preset_usage"))
+		return
+	}
+
+	if args[0] == "list" {
+		names, err := listPresets(collection, userID)
+		if err != nil {
+			reply(tr(lang, "db_error"))
+			return
+		}
+		if len(names) == 0 {
+			reply(tr(lang, "preset_none"))
+			return
+		}
+		reply(tr(lang, "preset_list") + "\n" + strings.Join(names, "\n"))
+		return
+	}
+
+	if len(args) < 2 {
+		reply(tr(lang, "preset_name_needed", args[0]))
+		return
+	}
+	name := args[1]
+	if len(name) > maxPresetNameLen {
+		reply(tr(lang, "preset_name_long", maxPresetNameLen))
+		return
+	}
+
+	switch args[0] {
+	case "save":
+		// Keep the prompt's own formatting: take the raw text after the name.
+		prompt := strings.TrimSpace(message.CommandArguments())
+		prompt = strings.TrimSpace(strings.TrimPrefix(prompt, args[0]))
+		prompt = strings.TrimSpace(strings.TrimPrefix(prompt, name))
+		if prompt == "" {
+			prefs, err := getUserPrefs(collection, prefsID)
+			if err != nil {
+				reply(tr(lang, "prefs_error"))
+				return
+			}
+			prompt = prefs.SystemPrompt
+		}
+		if prompt == "" {
+			reply(tr(lang, "preset_no_prompt"))
+			return
+		}
+		if len([]rune(prompt)) > maxSystemPromptLen {
+			reply(tr(lang, "system_too_long", maxSystemPromptLen))
+			return
+		}
+		if err := savePreset(collection, userID, name, prompt); err != nil {
+			reply(tr(lang, "db_error"))
+			return
+		}
+		reply(tr(lang, "preset_saved", name))
+	case "use":
+		prompt, ok, err := getPreset(collection, userID, name)
+		if err != nil {
+			reply(tr(lang, "db_error"))
+			return
+		}
+		if !ok {
+			reply(tr(lang, "preset_not_found", name))
+			return
+		}
+		if err := setUserPref(collection, prefsID, "system_prompt", prompt); err != nil {
+			reply(tr(lang, "pref_error"))
+			return
+		}
+		reply(tr(lang, "preset_used", name))
+	case "delete":
+		ok, err := deletePreset(collection, userID, name)
+		if err != nil {
+			reply(tr(lang, "db_error"))
+			return
+		}
+		if !ok {
+			reply(tr(lang, "preset_not_found", name))
+			return
+		}
+		reply(tr(lang, "preset_deleted", name))
+	default:
+		reply(tr(lang, "preset_usage"))
+	}
+}
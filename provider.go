@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Provider sends a chat request to one of OpenAI's APIs. Requests and
+// responses use the chat completions shapes; other APIs convert to and
+// from them.
+type Provider interface {
+	Complete(ctx context.Context, apiKey string, req OpenAIRequest) (*OpenAIResponse, error)
+	// Stream passes content deltas to onDelta as they arrive and returns
+	// the assembled response.
+	Stream(ctx context.Context, apiKey string, req OpenAIRequest, onDelta func(string)) (*OpenAIResponse, error)
+}
+
+// provider is the API all OpenAI calls go through. Set at startup from
+// OPENAI_API.
+var provider Provider = chatCompletionsProvider{}
+
+// openAIClient sends all OpenAI requests. Set at startup from the config.
+var openAIClient = &http.Client{}
+
+// newOpenAIClient builds the HTTP client for OpenAI, routed through
+// proxyURL when set, adding headers to every request, tracking the rate
+// limits left and, with a positive throttle, slowing down as they run low
+// (see rateLimitTransport).
+// Besides http(s) proxies, socks5:// URLs (with optional user:password)
+// are supported by net/http directly.
+func newOpenAIClient(proxyURL string, headers map[string]string, throttle float64) (*http.Client, error) {
+	var transport http.RoundTripper = http.DefaultTransport
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "socks5", "socks5h", "http", "https":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+		}
+		proxied := http.DefaultTransport.(*http.Transport).Clone()
+		proxied.Proxy = http.ProxyURL(u)
+		transport = proxied
+	}
+	if len(headers) > 0 {
+		transport = headerTransport{base: transport, headers: headers}
+	}
+	transport = newRateLimitTransport(transport, throttle)
+	return &http.Client{Transport: debugTransport{base: transport}}, nil
+}
+
+// headerTransport sets extra headers on every request, replacing any of
+// the same name.
+type headerTransport struct {
+	base    http.RoundTripper
+	headers map[string]string
+}
+
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// newProvider returns the provider for an OPENAI_API value.
+func newProvider(api string) (Provider, error) {
+	switch api {
+	case "", "chat", "azure":
+		return chatCompletionsProvider{}, nil
+	case "responses":
+		return responsesProvider{}, nil
+	}
+	return nil, fmt.Errorf("unknown OpenAI API %q, want \"chat\", \"responses\" or \"azure\"", api)
+}
+
+// chatRequest builds the HTTP request of a chat completions call for
+// model. Set at startup: Azure OpenAI has its own URLs and auth.
+var chatRequest = openAIChatRequest
+
+func openAIChatRequest(ctx context.Context, apiKey, model string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", openAIAPIURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	return req, nil
+}
+
+// chatCompletionsProvider targets /v1/chat/completions, or an Azure
+// OpenAI deployment's equivalent.
+type chatCompletionsProvider struct{}
+
+func (chatCompletionsProvider) Complete(ctx context.Context, apiKey string, req OpenAIRequest) (*OpenAIResponse, error) {
+	return doOpenAIRequest(ctx, apiKey, req)
+}
+
+func (chatCompletionsProvider) Stream(ctx context.Context, apiKey string, req OpenAIRequest, onDelta func(string)) (*OpenAIResponse, error) {
+	return doOpenAIStream(ctx, apiKey, req, onDelta)
+}
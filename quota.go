@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ai_tg_bot/config"
+)
+
+// quotaDateLayout is the format of the date stored in {type: "quota"}
+// documents. Days are counted in UTC.
+const quotaDateLayout = "2006-01-02"
+
+type dailyQuota struct {
+	Date  string `bson:"date"`
+	Count int    `bson:"count"`
+}
+
+// consumeQuota counts one message against the user's daily quota and
+// reports whether it is still within limit. A stored date other than today
+// means the counter has reset. Callers hold the user lock.
+func consumeQuota(collection *mongo.Collection, userID int64, limit int) (bool, error) {
+	filter := bson.M{"user_id": userID, "type": "quota"}
+	today := time.Now().UTC().Format(quotaDateLayout)
+
+	var quota dailyQuota
+	err := findUserDoc(collection, userID, "quota", &quota)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return false, err
+	}
+	if quota.Date != today {
+		quota = dailyQuota{Date: today}
+	}
+	if quota.Count >= limit {
+		return false, nil
+	}
+
+	update := bson.M{"$set": bson.M{"date": today, "count": quota.Count + 1}}
+	opts := options.Update().SetUpsert(true)
+	_, err = collection.UpdateOne(context.TODO(), filter, update, opts)
+	return err == nil, err
+}
+
+// untilQuotaReset returns the time left until the daily quota resets.
+func untilQuotaReset() time.Duration {
+	now := time.Now().UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	return midnight.Sub(now).Truncate(time.Minute) + time.Minute
+}
+
+// checkDailyQuota consumes one message from the user's quota, telling the
+// user when the limit is reached. Database errors let the message through.
+// A zero chatID (inline queries) skips the notice.
+func checkDailyQuota(bot *tgbotapi.BotAPI, collection *mongo.Collection, cfg *config.Config, userID, chatID int64, lang string) bool {
+	if cfg.DailyMessageLimit <= 0 || cfg.IsAdmin(userID) {
+		return true
+	}
+	allowed, err := consumeQuota(collection, userID, cfg.DailyMessageLimit)
+	if err != nil {
+		log.Printf("Failed to check daily quota for user %d: %v", userID, err)
+		return true
+	}
+	if !allowed && chatID != 0 {
+		text := tr(lang, "quota_reached", cfg.DailyMessageLimit, untilQuotaReset())
+		bot.Send(tgbotapi.NewMessage(chatID, text))
+	}
+	return allowed
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxThrottleWait caps how long a request is held back for a rate limit
+// window to reset; past that it is sent and may meet a 429.
+const maxThrottleWait = 20 * time.Second
+
+// rateLimitState is what OpenAI's x-ratelimit-* headers last said about
+// one API key.
+type rateLimitState struct {
+	limitRequests, remainingRequests int
+	limitTokens, remainingTokens     int
+	requestsReset, tokensReset       time.Time
+	low                              bool // logged as running low
+}
+
+// rateLimitTransport tracks the rate limit headers of OpenAI responses per
+// API key, publishing what is left as metrics, and holds back requests for
+// a key that has less than threshold (a fraction of its limit) of its
+// requests or tokens left, until the window resets. That way a busy bot
+// slows down instead of running into 429s. A zero threshold only tracks.
+type rateLimitTransport struct {
+	base      http.RoundTripper
+	threshold float64
+
+	mu   sync.Mutex
+	keys map[string]*rateLimitState
+}
+
+func newRateLimitTransport(base http.RoundTripper, threshold float64) *rateLimitTransport {
+	return &rateLimitTransport{base: base, threshold: threshold, keys: map[string]*rateLimitState{}}
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := req.Header.Get("Authorization") + req.Header.Get("api-key")
+	if wait := t.delay(key); wait > 0 {
+		metricThrottleWaits.Add(1)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err == nil {
+		t.update(key, resp.Header)
+	}
+	return resp, err
+}
+
+// delay is how long to hold back a request for key.
+func (t *rateLimitTransport) delay(key string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.keys[key]
+	if !ok {
+		return 0
+	}
+	var until time.Time
+	if isLow(s.remainingRequests, s.limitRequests, t.threshold) {
+		until = s.requestsReset
+	}
+	if isLow(s.remainingTokens, s.limitTokens, t.threshold) && s.tokensReset.After(until) {
+		until = s.tokensReset
+	}
+	return min(time.Until(until), maxThrottleWait)
+}
+
+func isLow(remaining, limit int, threshold float64) bool {
+	return limit > 0 && float64(remaining) < threshold*float64(limit)
+}
+
+// update records the rate limit headers of a response, logging when a key
+// starts running low.
+func (t *rateLimitTransport) update(key string, h http.Header) {
+	limitRequests, ok := headerInt(h, "x-ratelimit-limit-requests")
+	if !ok {
+		return
+	}
+	now := time.Now()
+	s := rateLimitState{limitRequests: limitRequests}
+	s.remainingRequests, _ = headerInt(h, "x-ratelimit-remaining-requests")
+	s.limitTokens, _ = headerInt(h, "x-ratelimit-limit-tokens")
+	s.remainingTokens, _ = headerInt(h, "x-ratelimit-remaining-tokens")
+	s.requestsReset = now.Add(headerDuration(h, "x-ratelimit-reset-requests"))
+	s.tokensReset = now.Add(headerDuration(h, "x-ratelimit-reset-tokens"))
+	s.low = isLow(s.remainingRequests, s.limitRequests, t.threshold) || isLow(s.remainingTokens, s.limitTokens, t.threshold)
+
+	label := keyLabel(key)
+	setGauge(metricRateLimitRemaining, label+".requests", s.remainingRequests)
+	setGauge(metricRateLimitRemaining, label+".tokens", s.remainingTokens)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if prev, ok := t.keys[key]; s.low && (!ok || !prev.low) {
+		log.Printf("OpenAI rate limit running low: %d/%d requests and %d/%d tokens left, throttling",
+			s.remainingRequests, s.limitRequests, s.remainingTokens, s.limitTokens)
+	}
+	t.keys[key] = &s
+}
+
+// keyLabel names an API key in metrics by its last four characters, the
+// way OpenAI's dashboard shows keys.
+func keyLabel(key string) string {
+	if len(key) <= 4 {
+		return "key"
+	}
+	return "..." + key[len(key)-4:]
+}
+
+func headerInt(h http.Header, name string) (int, bool) {
+	n, err := strconv.Atoi(h.Get(name))
+	return n, err == nil
+}
+
+// headerDuration parses a reset header such as "1s" or "6m0s".
+func headerDuration(h http.Header, name string) time.Duration {
+	d, err := time.ParseDuration(h.Get(name))
+	if err != nil {
+		return 0
+	}
+	return d
+}
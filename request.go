@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ai_tg_bot/config"
+)
+
+const jsonModeInstruction = "Respond with a single valid JSON object."
+
+// maxVariants caps /variants: every variant is billed as a full answer.
+const maxVariants = 4
+
+// lengthPreset maps a /length choice to a hidden instruction and a max_tokens cap.
+type lengthPreset struct {
+	Instruction string
+	MaxTokens   int
+}
+
+var lengthPresets = map[string]lengthPreset{
+	"short":  {Instruction: "Answer briefly, in a few sentences at most.", MaxTokens: 300},
+	"medium": {Instruction: "Answer with a moderate level of detail.", MaxTokens: 1000},
+	"long":   {Instruction: "Answer thoroughly and in detail.", MaxTokens: 4000},
+}
+
+// buildMessages turns the stored history into the message list sent to
+// OpenAI, prepending system-level hints derived from the config, the user's
+// prefs and language, and the chat hint of groupContextHint. The hints are
+// never stored in history.
+func buildMessages(cfg *config.Config, prefs UserPrefs, lang, chatHint string, history []ChatMessage) []OpenAIMessage {
+	var messages []OpenAIMessage
+	if cfg.AssistantName != "" {
+		persona := fmt.Sprintf("You are %s.", cfg.AssistantName)
+		messages = append(messages, OpenAIMessage{Role: "system", Content: persona})
+	}
+	if prompt := prefs.SystemPrompt; prompt != "" {
+		messages = append(messages, OpenAIMessage{Role: "system", Content: prompt})
+	} else if prompt := defaultSystemPrompt(); prompt != "" {
+		messages = append(messages, OpenAIMessage{Role: "system", Content: prompt})
+	}
+	if preset, ok := lengthPresets[prefs.Length]; ok {
+		messages = append(messages, OpenAIMessage{Role: "system", Content: preset.Instruction})
+	}
+	if hint, ok := replyLanguageHints[lang]; ok {
+		messages = append(messages, OpenAIMessage{Role: "system", Content: hint})
+	}
+	if chatHint != "" {
+		messages = append(messages, OpenAIMessage{Role: "system", Content: chatHint})
+	}
+	messages = append(messages, fewShotMessages...)
+	return append(messages, historyMessages(history)...)
+}
+
+// buildRequest assembles the OpenAI request parameters for a user. User
+// prefs take precedence over per-model defaults, which take precedence over
+// the global defaults.
+func buildRequest(cfg *config.Config, userID int64, model string, prefs UserPrefs, messages []OpenAIMessage) OpenAIRequest {
+	params := cfg.ParamsFor(model)
+	req := OpenAIRequest{
+		Model:       model,
+		Messages:    messages,
+		MaxTokens:   params.MaxTokens,
+		Temperature: params.Temperature,
+		User:        hashUserID(cfg.UserHashSalt, userID),
+		LogitBias:   cfg.LogitBias,
+	}
+	if preset, ok := lengthPresets[prefs.Length]; ok {
+		req.MaxTokens = preset.MaxTokens
+	}
+	if req.Temperature == nil && cfg.TemperatureRange != nil {
+		r := cfg.TemperatureRange
+		t := r.Min + rand.Float64()*(r.Max-r.Min)
+		req.Temperature = &t
+	}
+	if req.MaxTokens == 0 && cfg.AutoMaxTokens {
+		req.MaxTokens = fitMaxTokens(model, messages)
+	}
+	req.Seed = prefs.Seed
+	req.TopP = prefs.TopP
+	if wantsAudio(cfg, model) {
+		req.Modalities = []string{"text", "audio"}
+		req.Audio = &AudioOptions{Voice: cfg.AudioVoice, Format: audioFormat}
+	}
+	if prefs.Variants > 1 {
+		n := prefs.Variants
+		req.N = &n
+	}
+	if prefs.JSONMode {
+		req.ResponseFormat = &ResponseFormat{Type: "json_object"}
+		// OpenAI rejects json_object mode unless the prompt mentions JSON.
+		if !mentionsJSON(req.Messages) {
+			hint := OpenAIMessage{Role: "system", Content: jsonModeInstruction}
+			req.Messages = append([]OpenAIMessage{hint}, req.Messages...)
+		}
+	}
+	return req
+}
+
+func mentionsJSON(messages []OpenAIMessage) bool {
+	for _, msg := range messages {
+		if msg.Role != "assistant" && strings.Contains(strings.ToLower(msg.Content), "json") {
+			return true
+		}
+	}
+	return false
+}
+
+// brandReply prefixes a reply with the assistant's name when configured.
+func brandReply(cfg *config.Config, text string) string {
+	if cfg.AssistantName == "" || !cfg.AssistantNamePrefix {
+		return text
+	}
+	return cfg.AssistantName + ": " + text
+}
+
+// hashUserID derives the stable end-user identifier sent to OpenAI for abuse
+// tracking, so the raw Telegram ID never leaves the bot. The salt keeps the
+// small Telegram ID space from being brute-forced back.
+func hashUserID(salt string, userID int64) string {
+	sum := sha256.Sum256([]byte(salt + ":" + strconv.FormatInt(userID, 10)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// loadUserHashSalt returns the salt stored in the bot_state document,
+// storing a random one first if there is none yet. It stands in for
+// USER_HASH_SALT when that is unset, so IDs are never hashed unsalted and
+// stay stable across restarts and instances.
+func loadUserHashSalt(collection *mongo.Collection) (string, error) {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
+	}
+	update := bson.A{bson.M{"$set": bson.M{
+		"user_hash_salt": bson.M{"$ifNull": bson.A{"$user_hash_salt", hex.EncodeToString(b)}},
+	}}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var state struct {
+		UserHashSalt string `bson:"user_hash_salt"`
+	}
+	err := collection.FindOneAndUpdate(context.TODO(), botStateFilter, update, opts).Decode(&state)
+	return state.UserHashSalt, err
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const openAIResponsesURL = "https://api.openai.com/v1/responses"
+
+// responsesRequest is the /v1/responses request body. Seed and logit_bias
+// have no equivalent there and are dropped.
+type responsesRequest struct {
+	Model           string          `json:"model"`
+	Input           []OpenAIMessage `json:"input"`
+	MaxOutputTokens int             `json:"max_output_tokens,omitempty"`
+	Temperature     *float64        `json:"temperature,omitempty"`
+	TopP            *float64        `json:"top_p,omitempty"`
+	User            string          `json:"user,omitempty"`
+	Text            *responsesText  `json:"text,omitempty"`
+	Store           *bool           `json:"store,omitempty"`
+
+	Reasoning *responsesReasoning `json:"reasoning,omitempty"`
+}
+
+type responsesReasoning struct {
+	Effort string `json:"effort"`
+}
+
+type responsesText struct {
+	Format ResponseFormat `json:"format"`
+}
+
+type responsesResponse struct {
+	Model             string `json:"model"`
+	Status            string `json:"status"`
+	IncompleteDetails *struct {
+		Reason string `json:"reason"`
+	} `json:"incomplete_details"`
+	Output []struct {
+		Type    string `json:"type"`
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+	} `json:"output"`
+	Usage *struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+		TotalTokens  int `json:"total_tokens"`
+	} `json:"usage"`
+	Error *APIError `json:"error"`
+}
+
+// responsesProvider targets /v1/responses.
+type responsesProvider struct{}
+
+func (responsesProvider) Complete(ctx context.Context, apiKey string, req OpenAIRequest) (*OpenAIResponse, error) {
+	store := false // history lives in MongoDB, not on OpenAI's side
+	body := responsesRequest{
+		Model:           req.Model,
+		Input:           req.Messages,
+		MaxOutputTokens: req.MaxTokens,
+		Temperature:     req.Temperature,
+		TopP:            req.TopP,
+		User:            req.User,
+		Store:           &store,
+	}
+	if req.ResponseFormat != nil {
+		body.Text = &responsesText{Format: *req.ResponseFormat}
+	}
+	if body.MaxOutputTokens == 0 {
+		body.MaxOutputTokens = req.MaxCompletionTokens
+	}
+	if req.ReasoningEffort != "" {
+		body.Reasoning = &responsesReasoning{Effort: req.ReasoningEffort}
+	}
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", openAIResponsesURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := openAIClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var out responsesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	if out.Error != nil {
+		out.Error.StatusCode = resp.StatusCode
+		return nil, out.Error
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &APIError{StatusCode: resp.StatusCode, Message: "unexpected status " + resp.Status}
+	}
+
+	var text strings.Builder
+	for _, item := range out.Output {
+		if item.Type != "message" {
+			continue
+		}
+		for _, part := range item.Content {
+			if part.Type == "output_text" {
+				text.WriteString(part.Text)
+			}
+		}
+	}
+	if text.Len() == 0 {
+		return nil, ErrEmptyResponse
+	}
+
+	result := &OpenAIResponse{
+		Model: out.Model,
+		Choices: []OpenAIChoice{{
+			Message:      OpenAIMessage{Role: "assistant", Content: text.String()},
+			FinishReason: responsesFinishReason(out),
+		}},
+	}
+	if out.Usage != nil {
+		result.Usage = &Usage{
+			PromptTokens:     out.Usage.InputTokens,
+			CompletionTokens: out.Usage.OutputTokens,
+			TotalTokens:      out.Usage.TotalTokens,
+		}
+	}
+	return result, nil
+}
+
+// Stream is not streamed yet: the full answer is delivered as one delta.
+func (p responsesProvider) Stream(ctx context.Context, apiKey string, req OpenAIRequest, onDelta func(string)) (*OpenAIResponse, error) {
+	resp, err := p.Complete(ctx, apiKey, req)
+	if err != nil {
+		return nil, err
+	}
+	onDelta(resp.Choices[0].Message.Content)
+	return resp, nil
+}
+
+// responsesFinishReason maps a response status to the chat completions
+// finish_reason.
+func responsesFinishReason(out responsesResponse) string {
+	if out.Status != "incomplete" || out.IncompleteDetails == nil {
+		return "stop"
+	}
+	switch out.IncompleteDetails.Reason {
+	case "max_output_tokens":
+		return "length"
+	case "content_filter":
+		return "content_filter"
+	}
+	return out.IncompleteDetails.Reason
+}
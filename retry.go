@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// OpenAI retry settings, set at startup from the config. 0 retries
+// disables retrying.
+var (
+	openAIMaxRetries   = 2
+	openAIRetryBackoff = 500 * time.Millisecond // doubled after every failed attempt
+)
+
+const maxOpenAIBackoff = 10 * time.Second
+
+// isRetryable reports whether a failed OpenAI call may succeed if simply
+// sent again: server errors, rate limits (but not an exhausted quota) and
+// network failures. An open circuit, a canceled request and every other
+// API error are final.
+func isRetryable(err error) bool {
+	switch {
+	case errors.Is(err, errCircuitOpen), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.Is(err, ErrServer), errors.Is(err, ErrRateLimited):
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// retryDelay is the wait before retry attempt (counting from 0): an
+// exponential backoff with full jitter, a random delay between zero and
+// the backoff. When OpenAI fails for many requests at once, their
+// retries are then spread out instead of arriving in lockstep.
+func retryDelay(attempt int) time.Duration {
+	backoff := min(openAIRetryBackoff<<attempt, maxOpenAIBackoff)
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// withRetries runs call, retrying transient failures up to
+// openAIMaxRetries times while canRetry allows it (nil always does).
+func withRetries(ctx context.Context, canRetry func() bool, call func() (*OpenAIResponse, error)) (*OpenAIResponse, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := call()
+		if err == nil || attempt >= openAIMaxRetries || !isRetryable(err) || (canRetry != nil && !canRetry()) {
+			return resp, err
+		}
+		delay := retryDelay(attempt)
+		log.Printf("OpenAI request failed, retrying in %s: %v", delay.Round(time.Millisecond), err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return resp, err
+		}
+	}
+}
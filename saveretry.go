@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	maxSaveAttempts  = 5
+	saveRetryBackoff = time.Second // doubled after every failed attempt
+	maxSaveBackoff   = time.Minute
+)
+
+// pendingSave is a chat turn whose save failed and is waiting for a retry.
+type pendingSave struct {
+	userID   int64
+	session  string
+	messages []ChatMessage
+	attempts int
+	queued   time.Time // when the save first failed
+}
+
+var (
+	// saveRetrySlots bounds the saves waiting for a retry; nil when
+	// retries are disabled.
+	saveRetrySlots      chan struct{}
+	saveRetryCollection *mongo.Collection
+
+	// sessionResets records when each session's history was last cleared,
+	// keyed by sessionKey, so that retries don't bring back messages from
+	// before a /reset.
+	sessionResets sync.Map
+)
+
+type sessionKey struct {
+	userID  int64
+	session string // "" for every session of the user
+}
+
+// startSaveRetrier enables retrying failed history saves with exponential
+// backoff, counted for every save on its own. Up to size saves wait at a
+// time; 0 disables retries.
+func startSaveRetrier(collection *mongo.Collection, size int) {
+	if size <= 0 {
+		return
+	}
+	saveRetryCollection = collection
+	saveRetrySlots = make(chan struct{}, size)
+}
+
+// noteSessionReset records that the history of one user session, or of all
+// of them if session is empty, was cleared now.
+func noteSessionReset(userID int64, session string) {
+	sessionResets.Store(sessionKey{userID, session}, time.Now())
+}
+
+// resetSince reports whether the session was cleared after t.
+func resetSince(userID int64, session string, t time.Time) bool {
+	for _, key := range []sessionKey{{userID, session}, {userID, ""}} {
+		if at, ok := sessionResets.Load(key); ok && at.(time.Time).After(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueueSave queues a failed save for retry. When retries are disabled or
+// the queue is full the save is dropped with a warning. Messages keep their
+// timestamps, so a late save still loads in order.
+func enqueueSave(p pendingSave) {
+	if saveRetrySlots == nil {
+		return
+	}
+	select {
+	case saveRetrySlots <- struct{}{}:
+	default:
+		log.Printf("Warning: save retry queue is full, dropping chat history of user %d", p.userID)
+		metricSavesDropped.Add(1)
+		return
+	}
+	p.queued = time.Now()
+	scheduleSave(p)
+}
+
+func scheduleSave(p pendingSave) {
+	backoff := min(saveRetryBackoff<<p.attempts, maxSaveBackoff)
+	time.AfterFunc(backoff, func() { retrySave(p) })
+}
+
+// retrySave makes one more attempt at a queued save, under the user's lock
+// like any other history write. A save for a session reset since it
+// failed is dropped.
+func retrySave(p pendingSave) {
+	mu := userLock(p.userID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if resetSince(p.userID, p.session, p.queued) {
+		log.Printf("Dropping chat history save of user %d, session %q was reset", p.userID, p.session)
+		<-saveRetrySlots
+		return
+	}
+	p.attempts++
+	err := appendChatMessages(saveRetryCollection, p.userID, p.session, p.messages...)
+	if err == nil {
+		log.Printf("Saved chat history of user %d after %d retries", p.userID, p.attempts)
+		<-saveRetrySlots
+		return
+	}
+	if p.attempts >= maxSaveAttempts {
+		log.Printf("Giving up saving chat history of user %d after %d retries: %v", p.userID, p.attempts, err)
+		metricSavesDropped.Add(1)
+		<-saveRetrySlots
+		return
+	}
+	log.Printf("Retry %d of chat history save for user %d failed: %v", p.attempts, p.userID, err)
+	scheduleSave(p)
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ai_tg_bot/config"
+)
+
+// defaultSession is the implicit session every user starts in. Chat
+// documents written before sessions existed have no session field and
+// belong to it.
+const defaultSession = "default"
+
+const maxSessionNameLen = 32
+
+// Session returns the user's active session name.
+func (p UserPrefs) Session() string {
+	if p.ActiveSession == "" {
+		return defaultSession
+	}
+	return p.ActiveSession
+}
+
+// chatFilter matches the chat documents of one user session.
+func chatFilter(userID int64, session string) bson.M {
+	filter := bson.M{"user_id": userID, "type": "chat", "session": session}
+	if session == defaultSession {
+		filter["session"] = bson.M{"$in": []interface{}{nil, defaultSession}}
+	}
+	return filter
+}
+
+// clearChatHistory removes all chat messages of one user session.
+func clearChatHistory(collection *mongo.Collection, userID int64, session string) error {
+	_, err := collection.DeleteMany(context.TODO(), chatFilter(userID, session))
+	noteSessionReset(userID, session)
+	return err
+}
+
+// clearAllChatHistory removes the chat messages of every session of the
+// user. Sessions themselves, being only names, are kept.
+func clearAllChatHistory(collection *mongo.Collection, userID int64) error {
+	filter := bson.M{"user_id": userID, "type": "chat"}
+	_, err := collection.DeleteMany(context.TODO(), filter)
+	noteSessionReset(userID, "")
+	return err
+}
+
+// isEndKeyword reports whether text is one of the END_KEYWORDS, ignoring
+// case, surrounding spaces and trailing punctuation.
+func isEndKeyword(keywords []string, text string) bool {
+	text = strings.TrimRight(strings.TrimSpace(text), ".!?… ")
+	for _, keyword := range keywords {
+		if strings.EqualFold(text, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// endSession clears the session's history after a farewell keyword, like
+// /reset. The caller holds the user's lock.
+func endSession(bot *tgbotapi.BotAPI, collection *mongo.Collection, userID, chatID int64, lang, session string, stateless bool) {
+	if !stateless {
+		if err := clearChatHistory(collection, userID, session); err != nil {
+			log.Printf("Failed to end session %q of user %d: %v", session, userID, err)
+			sendError(bot, chatID, tr(lang, "reset_error"))
+			return
+		}
+	}
+	resetDisclaimer(collection, userID)
+	bot.Send(tgbotapi.NewMessage(chatID, tr(lang, "session_ended")))
+}
+
+// resetIfInactive clears the active session's history if the user's last
+// message came more than INACTIVITY_RESET ago, and records now as their
+// latest activity. It reports whether the session was reset. The caller
+// holds the user's lock.
+func resetIfInactive(collection *mongo.Collection, cfg *config.Config, userID int64, prefs UserPrefs) bool {
+	if cfg.InactivityReset <= 0 {
+		return false
+	}
+	now := time.Now()
+	if err := setUserPref(collection, userID, "last_active", now); err != nil {
+		log.Printf("Failed to record activity of user %d: %v", userID, err)
+	}
+	if prefs.LastActive.IsZero() || now.Sub(prefs.LastActive) < cfg.InactivityReset {
+		return false
+	}
+	if err := clearChatHistory(collection, userID, prefs.Session()); err != nil {
+		log.Printf("Failed to reset inactive session of user %d: %v", userID, err)
+		return false
+	}
+	return true
+}
+
+// lastAssistantMessage returns the latest stored reply of one user
+// session, or mongo.ErrNoDocuments if there is none.
+func lastAssistantMessage(collection *mongo.Collection, userID int64, session string) (string, error) {
+	filter := chatFilter(userID, session)
+	filter["role"] = "assistant"
+	opts := options.FindOne().SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}})
+	var msg ChatMessage
+	if err := collection.FindOne(context.TODO(), filter, opts).Decode(&msg); err != nil {
+		return "", err
+	}
+	return msg.Content, nil
+}
+
+// countChatMessages counts the stored user and assistant messages of one
+// user session.
+func countChatMessages(collection *mongo.Collection, userID int64, session string) (user, assistant int64, err error) {
+	filter := chatFilter(userID, session)
+	filter["role"] = "user"
+	if user, err = collection.CountDocuments(context.TODO(), filter); err != nil {
+		return 0, 0, err
+	}
+	filter["role"] = "assistant"
+	assistant, err = collection.CountDocuments(context.TODO(), filter)
+	return user, assistant, err
+}
+
+func sessionExists(collection *mongo.Collection, userID int64, name string) (bool, error) {
+	if name == defaultSession {
+		return true, nil
+	}
+	filter := bson.M{"user_id": userID, "type": "session", "name": name}
+	count, err := collection.CountDocuments(context.TODO(), filter)
+	return count > 0, err
+}
+
+func createSession(collection *mongo.Collection, userID int64, name string) error {
+	now := time.Now()
+	doc := bson.M{
+		"user_id":    userID,
+		"type":       "session",
+		"name":       name,
+		"created_at": now,
+		"last_used":  now,
+	}
+	_, err := collection.InsertOne(context.TODO(), doc)
+	return err
+}
+
+// touchSession records that a named session was just used, for
+// least-recently-used eviction. The default session is never evicted and
+// has no document.
+func touchSession(collection *mongo.Collection, userID int64, name string) error {
+	if name == defaultSession {
+		return nil
+	}
+	filter := bson.M{"user_id": userID, "type": "session", "name": name}
+	_, err := collection.UpdateOne(context.TODO(), filter, bson.M{"$set": bson.M{"last_used": time.Now()}})
+	return err
+}
+
+func countSessions(collection *mongo.Collection, userID int64) (int64, error) {
+	return collection.CountDocuments(context.TODO(), bson.M{"user_id": userID, "type": "session"})
+}
+
+// leastRecentlyUsedSession returns the named session, other than active,
+// that was used longest ago. Sessions created before last_used was tracked
+// count as the oldest.
+func leastRecentlyUsedSession(collection *mongo.Collection, userID int64, active string) (string, error) {
+	filter := bson.M{"user_id": userID, "type": "session", "name": bson.M{"$ne": active}}
+	opts := options.FindOne().SetSort(bson.D{{Key: "last_used", Value: 1}, {Key: "created_at", Value: 1}})
+	var doc struct {
+		Name string `bson:"name"`
+	}
+	err := collection.FindOne(context.TODO(), filter, opts).Decode(&doc)
+	return doc.Name, err
+}
+
+func listSessions(collection *mongo.Collection, userID int64) ([]string, error) {
+	filter := bson.M{"user_id": userID, "type": "session"}
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+	cursor, err := collection.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	names := []string{defaultSession}
+	for cursor.Next(context.TODO()) {
+		var doc struct {
+			Name string `bson:"name"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		names = append(names, doc.Name)
+	}
+	return names, nil
+}
+
+func deleteSession(collection *mongo.Collection, userID int64, name string) error {
+	if err := clearChatHistory(collection, userID, name); err != nil {
+		return err
+	}
+	_, err := collection.DeleteOne(context.TODO(), bson.M{"user_id": userID, "type": "session", "name": name})
+	return err
+}
+
+// handleSessionCommand implements /session new|switch|list|delete. With
+// MAX_SESSIONS set, creating a session beyond the cap is refused or, with
+// SESSION_EVICTION=lru, evicts the least recently used session.
+func handleSessionCommand(bot *tgbotapi.BotAPI, collection *mongo.Collection, cfg *config.Config, message *tgbotapi.Message, lang string) {
+	chatID := message.Chat.ID
+	userID := message.From.ID
+	reply := func(text string) {
+		bot.Send(tgbotapi.NewMessage(chatID, text))
+	}
+
+	parts := strings.Fields(message.Text)
+	if len(parts) < 2 {
+		reply(tr(lang, "session_usage"))
+		return
+	}
+
+	prefs, err := getUserPrefs(collection, userID)
+	if err != nil {
+		reply(tr(lang, "prefs_error"))
+		return
+	}
+
+	if parts[1] == "list" {
+		names, err := listSessions(collection, userID)
+		if err != nil {
+			reply(tr(lang, "session_list_error"))
+			return
+		}
+		var b strings.Builder
+		b.WriteString(tr(lang, "session_list") + "\n")
+		for _, name := range names {
+			marker := "  "
+			if name == prefs.Session() {
+				marker = "• "
+			}
+			b.WriteString(marker + name + "\n")
+		}
+		reply(b.String())
+		return
+	}
+
+	if len(parts) < 3 {
+		reply(tr(lang, "session_name_needed", parts[1]))
+		return
+	}
+	name := parts[2]
+	if len(name) > maxSessionNameLen {
+		reply(tr(lang, "session_name_long", maxSessionNameLen))
+		return
+	}
+
+	// Serialize with in-flight chat turns so a switch or delete never races a save.
+	mu := userLock(userID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	exists, err := sessionExists(collection, userID, name)
+	if err != nil {
+		reply(tr(lang, "db_error"))
+		return
+	}
+
+	switch parts[1] {
+	case "new":
+		if exists {
+			reply(tr(lang, "session_exists", name))
+			return
+		}
+		if cfg.MaxSessions > 0 {
+			count, err := countSessions(collection, userID)
+			if err != nil {
+				reply(tr(lang, "db_error"))
+				return
+			}
+			if count >= int64(cfg.MaxSessions) {
+				if cfg.SessionEviction != "lru" {
+					reply(tr(lang, "session_limit", cfg.MaxSessions))
+					return
+				}
+				evicted, err := leastRecentlyUsedSession(collection, userID, prefs.Session())
+				if err == nil {
+					err = deleteSession(collection, userID, evicted)
+				}
+				if err != nil {
+					reply(tr(lang, "session_create_err"))
+					return
+				}
+				reply(tr(lang, "session_evicted", evicted))
+			}
+		}
+		if err := createSession(collection, userID, name); err != nil {
+			reply(tr(lang, "session_create_err"))
+			return
+		}
+		if err := setUserPref(collection, userID, "active_session", name); err != nil {
+			reply(tr(lang, "session_switch_err"))
+			return
+		}
+		resetDisclaimer(collection, userID)
+		reply(tr(lang, "session_created", name))
+	case "switch":
+		if !exists {
+			reply(tr(lang, "session_not_found", name))
+			return
+		}
+		if err := setUserPref(collection, userID, "active_session", name); err != nil {
+			reply(tr(lang, "session_switch_err"))
+			return
+		}
+		if err := touchSession(collection, userID, name); err != nil {
+			log.Printf("Failed to update last use of session %q: %v", name, err)
+		}
+		resetDisclaimer(collection, userID)
+		reply(tr(lang, "session_switched", name))
+	case "delete":
+		if name == defaultSession {
+			reply(tr(lang, "session_no_default"))
+			return
+		}
+		if !exists {
+			reply(tr(lang, "session_not_found", name))
+			return
+		}
+		if err := deleteSession(collection, userID, name); err != nil {
+			reply(tr(lang, "session_delete_err"))
+			return
+		}
+		if prefs.Session() == name {
+			if err := unsetUserPref(collection, userID, "active_session"); err != nil {
+				reply(tr(lang, "session_switch_err"))
+				return
+			}
+			resetDisclaimer(collection, userID)
+			reply(tr(lang, "session_deleted_to", name, defaultSession))
+			return
+		}
+		reply(tr(lang, "session_deleted", name))
+	default:
+		reply(tr(lang, "session_unknown"))
+	}
+}
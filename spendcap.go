@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrSpendCap is returned instead of calling OpenAI once the SPEND_CAP
+// kill switch has tripped.
+var ErrSpendCap = errors.New("openai: monthly spend cap reached")
+
+// spendCapReached is set while the month's spend is at or over
+// SPEND_CAP: callOpenAI and streamOpenAI then fail with ErrSpendCap
+// without sending anything.
+var spendCapReached atomic.Bool
+
+// spendCapState tracks the monthly kill switch. An admin reset moves the start
+// of the counted spend to the time of the reset, stored in the bot_state
+// document so it survives restarts; a new month starts the count afresh.
+type spendCapState struct {
+	mu      sync.Mutex
+	limit   float64 // USD; 0 disables the cap
+	resetAt time.Time
+	spent   float64
+}
+
+var spendCap = &spendCapState{}
+
+// startSpendCapWatcher restores the last reset and re-aggregates the spend
+// every budgetRefreshInterval, tripping or releasing the kill switch.
+func startSpendCapWatcher(collection *mongo.Collection, limit float64) error {
+	if limit <= 0 {
+		return nil
+	}
+	var state struct {
+		SpendCapResetAt time.Time `bson:"spend_cap_reset_at"`
+	}
+	err := collection.FindOne(context.TODO(), botStateFilter).Decode(&state)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	spendCap.mu.Lock()
+	spendCap.limit, spendCap.resetAt = limit, state.SpendCapResetAt
+	spendCap.mu.Unlock()
+
+	spendCap.refresh(collection)
+	go func() {
+		ticker := time.NewTicker(budgetRefreshInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			spendCap.refresh(collection)
+		}
+	}()
+	return nil
+}
+
+// since is when the counted spend starts: the start of the UTC month, or
+// the last reset if that came later.
+func (s *spendCapState) since() time.Time {
+	now := time.Now().UTC()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if s.resetAt.After(monthStart) {
+		return s.resetAt
+	}
+	return monthStart
+}
+
+// refresh sums the spend since the period start and updates the kill
+// switch, logging when it trips or is released. On errors the switch is
+// left as it is.
+func (s *spendCapState) refresh(collection *mongo.Collection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	spent, err := sumCostSince(collection, s.since())
+	if err != nil {
+		log.Printf("Failed to aggregate spend for the spend cap: %v", err)
+		return
+	}
+	s.spent = spent
+	reached := spent >= s.limit
+	if spendCapReached.Swap(reached) != reached {
+		if reached {
+			log.Printf("Warning: spend cap of $%.2f reached ($%.2f spent), stopping all OpenAI requests", s.limit, spent)
+		} else {
+			log.Printf("Spend cap released, $%.2f of $%.2f spent", spent, s.limit)
+		}
+	}
+}
+
+// add counts the cost of a request right away, so the kill switch trips
+// without waiting for the next refresh.
+func (s *spendCapState) add(cost float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.limit <= 0 {
+		return
+	}
+	s.spent += cost
+	if s.spent >= s.limit && !spendCapReached.Swap(true) {
+		log.Printf("Warning: spend cap of $%.2f reached ($%.2f spent), stopping all OpenAI requests", s.limit, s.spent)
+	}
+}
+
+// reset starts counting the spend anew from now and releases the kill
+// switch.
+func (s *spendCapState) reset(collection *mongo.Collection) error {
+	now := time.Now().UTC()
+	update := bson.M{"$set": bson.M{"spend_cap_reset_at": now}}
+	opts := options.Update().SetUpsert(true)
+	if _, err := collection.UpdateOne(context.TODO(), botStateFilter, update, opts); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.resetAt = now
+	s.mu.Unlock()
+	s.refresh(collection)
+	return nil
+}
+
+// status returns the spend counted against the cap, the cap and when the
+// count started.
+func (s *spendCapState) status() (spent, limit float64, since time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.spent, s.limit, s.since()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const codeFence = "```"
+
+// codeBlock is the byte span of a fenced code block, from the start of its
+// opening fence line to the end of its closing fence line. An unclosed
+// block runs to the end of the text.
+type codeBlock struct {
+	start, end int
+	opening    string // opening fence line, e.g. "```go"
+}
+
+func findCodeBlocks(text string) []codeBlock {
+	var blocks []codeBlock
+	var open *codeBlock
+	for pos := 0; pos < len(text); {
+		end := len(text)
+		if i := strings.IndexByte(text[pos:], '\n'); i >= 0 {
+			end = pos + i + 1
+		}
+		line := strings.TrimSpace(text[pos:end])
+		if strings.HasPrefix(line, codeFence) {
+			if open == nil {
+				open = &codeBlock{start: pos, opening: line}
+			} else {
+				open.end = end
+				blocks = append(blocks, *open)
+				open = nil
+			}
+		}
+		pos = end
+	}
+	if open != nil {
+		open.end = len(text)
+		blocks = append(blocks, *open)
+	}
+	return blocks
+}
+
+// splitCodeAware splits text like splitAtBoundary, but keeps fenced code
+// blocks whole: a block that does not fit moves to the next message along
+// with everything after it. A block too large for a message of its own is
+// hard split, closing the fence at the end of head and reopening it at the
+// start of tail so both halves still render as code.
+func splitCodeAware(text string, limit int) (head, tail string) {
+	head, tail = splitAtBoundary(text, limit)
+	if tail == "" {
+		return head, tail
+	}
+	cut := len(head)
+	for _, b := range findCodeBlocks(text) {
+		if cut <= b.start || cut >= b.end {
+			continue
+		}
+		if strings.TrimSpace(text[:b.start]) != "" {
+			return text[:b.start], text[b.start:]
+		}
+		closing := "\n" + codeFence
+		head, tail = splitAtBoundary(text, limit-utf16Len(closing))
+		if !strings.HasSuffix(head, "\n") {
+			head += "\n"
+		}
+		return head + codeFence, b.opening + "\n" + tail
+	}
+	return head, tail
+}
+
+// splitMessage breaks text into pieces that each fit into a Telegram
+// message.
+func splitMessage(text string) []string {
+	var parts []string
+	for utf16Len(text) > telegramMessageLimit {
+		head, tail := splitCodeAware(text, telegramMessageLimit)
+		parts = append(parts, head)
+		text = tail
+	}
+	return append(parts, text)
+}
+
+// sendLongMessage sends text, split over as many messages as it needs.
+func sendLongMessage(bot *tgbotapi.BotAPI, chatID int64, text string) {
+	for _, part := range splitMessage(text) {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		if _, err := bot.Send(tgbotapi.NewMessage(chatID, part)); err != nil {
+			log.Printf("Failed to send message: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// statsdClient pushes the bot's metrics to a StatsD server over UDP: the
+// expvar counters as StatsD counters, every flush interval, and timings
+// of OpenAI and MongoDB calls as they happen.
+type statsdClient struct {
+	conn   net.Conn
+	prefix string
+	last   map[string]int64 // counter values at the previous flush
+}
+
+// statsd is the active exporter, nil unless METRICS_EXPORTER=statsd.
+var statsd atomic.Pointer[statsdClient]
+
+// startStatsD sends counters and timings to the StatsD daemon at addr.
+func startStatsD(addr, prefix string, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("STATSD_INTERVAL must be positive")
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	c := &statsdClient{conn: conn, prefix: prefix, last: map[string]int64{}}
+	statsd.Store(c)
+	go func() {
+		for range time.Tick(interval) {
+			c.flushCounters()
+		}
+	}()
+	log.Printf("Exporting metrics to StatsD at %s", addr)
+	return nil
+}
+
+// flushCounters sends how much each expvar counter grew since the last
+// flush.
+func (c *statsdClient) flushCounters() {
+	var lines []string
+	expvar.Do(func(kv expvar.KeyValue) {
+		v, ok := kv.Value.(*expvar.Int)
+		if !ok {
+			return
+		}
+		value := v.Value()
+		if delta := value - c.last[kv.Key]; delta != 0 {
+			lines = append(lines, fmt.Sprintf("%s%s:%d|c", c.prefix, kv.Key, delta))
+		}
+		c.last[kv.Key] = value
+	})
+	for _, line := range lines {
+		c.send(line)
+	}
+}
+
+func (c *statsdClient) send(line string) {
+	// UDP: a lost packet only loses a sample, so errors are not logged.
+	c.conn.Write([]byte(line))
+}
+
+// observeTiming reports how long an operation took, e.g.
+// "openai.request", if metrics are exported.
+func observeTiming(name string, d time.Duration) {
+	if e := otlp.Load(); e != nil {
+		e.observe(name, d)
+	}
+	c := statsd.Load()
+	if c == nil {
+		return
+	}
+	name = strings.ReplaceAll(name, ":", "_")
+	c.send(fmt.Sprintf("%s%s:%d|ms", c.prefix, name, d.Milliseconds()))
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// telegramMessageLimit is the maximum message length, in UTF-16 code units.
+const telegramMessageLimit = 4096
+
+// streamEditInterval throttles message edits while a reply is streaming.
+const streamEditInterval = time.Second
+
+type openAIStreamChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Model             string `json:"model"`
+	SystemFingerprint string `json:"system_fingerprint"`
+	Usage             *Usage `json:"usage"` // only in the final chunk, which has no choices
+}
+
+// streamOpenAI performs a streaming chat completion, passing every content
+// delta to onDelta, and returns the assembled response.
+func streamOpenAI(ctx context.Context, reqBody OpenAIRequest, onDelta func(string)) (*OpenAIResponse, error) {
+	if spendCapReached.Load() {
+		return nil, ErrSpendCap
+	}
+	reqBody = adaptRequest(reqBody)
+	ctx, span := startSpan(ctx, "openai.stream", "gen_ai.request.model", reqBody.Model)
+	started := time.Now()
+	defer func() { observeTiming("openai.stream", time.Since(started)) }()
+	// Once part of the reply has been passed on, a retry would repeat it.
+	streamed := false
+	pass := onDelta
+	onDelta = func(delta string) {
+		streamed = true
+		pass(delta)
+	}
+	resp, err := withRetries(ctx, func() bool { return !streamed }, func() (*OpenAIResponse, error) {
+		return withBreaker(func() (*OpenAIResponse, error) {
+			apiKey := apiKeys.Pick()
+			write := onDelta
+			var processed *postprocessedStream
+			if len(postProcessors) > 0 {
+				processed = newPostprocessedStream(onDelta)
+				write = processed.Write
+			}
+			resp, err := provider.Stream(ctx, apiKey, reqBody, write)
+			apiKeys.Report(apiKey, err)
+			if err == nil && processed != nil {
+				processed.Flush()
+				err = postprocessResponse(resp)
+			}
+			return resp, err
+		})
+	})
+	if err == nil {
+		err = checkContentFilter(resp)
+	}
+	span.End(err)
+	return resp, err
+}
+
+func doOpenAIStream(ctx context.Context, apiKey string, reqBody OpenAIRequest, onDelta func(string)) (*OpenAIResponse, error) {
+	reqBody.Stream = true
+	reqBody.StreamOptions = &StreamOptions{IncludeUsage: true}
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := chatRequest(ctx, apiKey, reqBody.Model, jsonData)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := openAIClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Errors come back as a plain JSON body rather than an event stream.
+	if resp.StatusCode != http.StatusOK {
+		var errResp OpenAIResponse
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err == nil && errResp.Error != nil {
+			errResp.Error.StatusCode = resp.StatusCode
+			return nil, errResp.Error
+		}
+		return nil, &APIError{StatusCode: resp.StatusCode, Message: "unexpected status " + resp.Status}
+	}
+
+	var content strings.Builder
+	result := &OpenAIResponse{}
+	var finishReason string
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			break
+		}
+		var chunk openAIStreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return nil, fmt.Errorf("openai: decode stream chunk: %w", err)
+		}
+		if chunk.Model != "" {
+			result.Model = chunk.Model
+		}
+		if chunk.SystemFingerprint != "" {
+			result.SystemFingerprint = chunk.SystemFingerprint
+		}
+		if chunk.Usage != nil {
+			result.Usage = chunk.Usage
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content != "" {
+				content.WriteString(choice.Delta.Content)
+				onDelta(choice.Delta.Content)
+			}
+			if choice.FinishReason != "" {
+				finishReason = choice.FinishReason
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if content.Len() == 0 {
+		return nil, ErrEmptyResponse
+	}
+
+	result.Choices = []OpenAIChoice{{
+		Message:      OpenAIMessage{Role: "assistant", Content: content.String()},
+		FinishReason: finishReason,
+	}}
+	return result, nil
+}
+
+// streamMessage renders a streamed reply into Telegram by editing a message
+// in place. When the text would outgrow a single message, the current one
+// is finalized and the rest continues in a new message.
+type streamMessage struct {
+	bot       *tgbotapi.BotAPI
+	chatID    int64
+	messageID int    // message being edited; 0 until first sent
+	text      string // full text of the current message
+	shown     string // text Telegram currently displays
+	lastFlush time.Time
+}
+
+func newStreamMessage(bot *tgbotapi.BotAPI, chatID int64) *streamMessage {
+	return &streamMessage{bot: bot, chatID: chatID}
+}
+
+// Write appends delta, rolling over to new messages as needed, and pushes
+// an edit at most once per streamEditInterval.
+func (s *streamMessage) Write(delta string) {
+	s.text += delta
+	for utf16Len(s.text) > telegramMessageLimit {
+		head, tail := splitCodeAware(s.text, telegramMessageLimit)
+		s.text = head
+		s.flush()
+		s.messageID = 0
+		s.text = tail
+		s.shown = ""
+	}
+	if time.Since(s.lastFlush) >= streamEditInterval {
+		s.flush()
+	}
+}
+
+// usePlaceholder makes the first message an edit of p rather than a new
+// message. The stream takes p over: p itself no longer edits or deletes.
+func (s *streamMessage) usePlaceholder(p *placeholder) {
+	s.messageID, p.messageID = p.messageID, 0
+}
+
+// Reset drops the text of the current message, so that a retried reply
+// is streamed over it. Messages already rolled over from stay as they are.
+func (s *streamMessage) Reset() {
+	s.text = ""
+}
+
+// Close pushes whatever has not been shown yet. A placeholder that never
+// got any text is deleted.
+func (s *streamMessage) Close() {
+	s.flush()
+	if s.shown == "" && s.messageID != 0 {
+		if _, err := s.bot.Request(tgbotapi.NewDeleteMessage(s.chatID, s.messageID)); err != nil {
+			log.Printf("Failed to delete placeholder: %v", err)
+		}
+		s.messageID = 0
+	}
+}
+
+func (s *streamMessage) flush() {
+	if strings.TrimSpace(s.text) == "" || s.text == s.shown {
+		return
+	}
+	s.lastFlush = time.Now()
+	if s.messageID != 0 {
+		_, err := s.bot.Send(tgbotapi.NewEditMessageText(s.chatID, s.messageID, s.text))
+		if err == nil {
+			s.shown = s.text
+			return
+		}
+		if !isEditTargetMissing(err) {
+			log.Printf("Failed to edit streamed message: %v", err)
+			return
+		}
+		// The message was deleted mid-stream: carry on in a new one.
+		log.Printf("Streamed message %d is gone, sending a new one", s.messageID)
+		s.messageID = 0
+	}
+	sent, err := s.bot.Send(tgbotapi.NewMessage(s.chatID, s.text))
+	if err != nil {
+		log.Printf("Failed to send streamed message: %v", err)
+		return
+	}
+	s.messageID = sent.MessageID
+	s.shown = s.text
+}
+
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
+
+// splitAtBoundary splits text so that head fits into limit UTF-16 code
+// units, preferring to break after a newline or space in the last quarter
+// of the allowed length.
+func splitAtBoundary(text string, limit int) (head, tail string) {
+	cut, units := 0, 0
+	for i, r := range text {
+		n := utf16.RuneLen(r)
+		if units+n > limit {
+			break
+		}
+		units += n
+		cut = i + len(string(r))
+	}
+	if cut >= len(text) {
+		return text, ""
+	}
+	minCut := cut * 3 / 4
+	if i := strings.LastIndex(text[:cut], "\n"); i >= minCut {
+		cut = i + 1
+	} else if i := strings.LastIndex(text[:cut], " "); i >= minCut {
+		cut = i + 1
+	}
+	return text[:cut], text[cut:]
+}
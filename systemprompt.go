@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultPrompt holds the system prompt for users without one of their own.
+var defaultPrompt atomic.Value // string
+
+func defaultSystemPrompt() string {
+	prompt, _ := defaultPrompt.Load().(string)
+	return prompt
+}
+
+func setDefaultSystemPrompt(prompt string) {
+	defaultPrompt.Store(strings.TrimSpace(prompt))
+}
+
+// loadDefaultSystemPrompt replaces the default system prompt with the
+// contents of path.
+func loadDefaultSystemPrompt(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	setDefaultSystemPrompt(string(data))
+	return nil
+}
+
+// watchDefaultSystemPrompt polls path every interval and reloads the
+// default system prompt when its modification time or size changes. A
+// file that cannot be read keeps the previous prompt in use.
+func watchDefaultSystemPrompt(path string, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	var lastMod time.Time
+	var lastSize int64
+	if info, err := os.Stat(path); err == nil {
+		lastMod, lastSize = info.ModTime(), info.Size()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("Failed to check default system prompt file: %v", err)
+			continue
+		}
+		if info.ModTime().Equal(lastMod) && info.Size() == lastSize {
+			continue
+		}
+		if err := loadDefaultSystemPrompt(path); err != nil {
+			log.Printf("Failed to reload default system prompt: %v", err)
+			continue
+		}
+		lastMod, lastSize = info.ModTime(), info.Size()
+		log.Printf("Reloaded default system prompt from %s", path)
+	}
+}
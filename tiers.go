@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"path"
+
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"ai_tg_bot/config"
+)
+
+// userTier is the tier a user's prefs place them in, DEFAULT_TIER for
+// users no admin has assigned one.
+func userTier(cfg *config.Config, prefs UserPrefs) string {
+	if prefs.Tier != "" {
+		return prefs.Tier
+	}
+	return cfg.DefaultTier
+}
+
+// modelAllowed reports whether users of tier may use model. TIER_MODELS
+// lists each tier's models as glob patterns, e.g. "gpt-4o-mini*" or "*".
+// Without TIER_MODELS, or for a tier it doesn't list, every model is
+// allowed.
+func modelAllowed(cfg *config.Config, tier, model string) bool {
+	patterns, ok := cfg.TierModels[tier]
+	if !ok {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, model); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// validTier reports whether an admin may assign tier: any name without
+// TIER_MODELS, otherwise only the tiers it lists.
+func validTier(cfg *config.Config, tier string) bool {
+	if len(cfg.TierModels) == 0 {
+		return true
+	}
+	_, ok := cfg.TierModels[tier]
+	return ok
+}
+
+// requestModel returns the model requests under prefsID are sent to: the
+// one picked with /model, or DEFAULT_MODEL when none was picked or the
+// user's tier no longer allows it, as after a demotion. prefs must carry
+// the user's tier, as loadPrefs returns it.
+func requestModel(collection *mongo.Collection, cfg *config.Config, prefsID int64, prefs UserPrefs) string {
+	model, err := getUserModel(collection, prefsID)
+	if err != nil || model == "" {
+		return cfg.DefaultModel
+	}
+	if tier := userTier(cfg, prefs); !modelAllowed(cfg, tier, model) {
+		log.Printf("Model %s of %d is not in tier %q, using %s", model, prefsID, tier, cfg.DefaultModel)
+		return cfg.DefaultModel
+	}
+	return model
+}
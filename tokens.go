@@ -0,0 +1,39 @@
+package main
+
+import "unicode/utf8"
+
+const (
+	// charsPerToken is a rough average for English text; other languages
+	// use more tokens per character, which the margin below absorbs.
+	charsPerToken = 4
+	// tokensPerMessage covers the role and framing of each message.
+	tokensPerMessage = 4
+	// contextSafetyMargin keeps a share of the window free for estimation error.
+	contextSafetyMargin = 0.1
+
+	minAutoMaxTokens = 256
+)
+
+// estimateTokens approximates the prompt size of messages without a
+// tokenizer.
+func estimateTokens(messages []OpenAIMessage) int {
+	tokens := 0
+	for _, msg := range messages {
+		tokens += tokensPerMessage + (utf8.RuneCountInString(msg.Content)+charsPerToken-1)/charsPerToken
+	}
+	return tokens
+}
+
+// fitMaxTokens returns a max_tokens value that fits what is left of the
+// model's context window after the prompt, clamped to the model's output
+// limit and to minAutoMaxTokens. Unknown and reasoning models get 0 (not
+// set): the former have no known window and the latter reject max_tokens.
+func fitMaxTokens(model string, messages []OpenAIMessage) int {
+	info, ok := lookupModel(model)
+	if !ok || info.Reasoning {
+		return 0
+	}
+	margin := int(float64(info.ContextWindow) * contextSafetyMargin)
+	remaining := info.ContextWindow - estimateTokens(messages) - margin
+	return min(max(remaining, minAutoMaxTokens), info.MaxOutput)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// userLocks serializes history reads and writes per user so that a chat
+// turn and the background trimmer never interleave their delete/insert.
+var userLocks sync.Map // map[int64]*sync.Mutex
+
+func userLock(userID int64) *sync.Mutex {
+	mu, _ := userLocks.LoadOrStore(userID, &sync.Mutex{})
+	return mu.(*sync.Mutex)
+}
+
+// startHistoryTrimmer periodically caps every user's stored chat history to
+// the maxMessages most recent messages.
+func startHistoryTrimmer(collection *mongo.Collection, interval time.Duration, maxMessages int) {
+	if interval <= 0 || maxMessages <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			trimAllHistories(collection, maxMessages)
+		}
+	}()
+}
+
+func trimAllHistories(collection *mongo.Collection, maxMessages int) {
+	userIDs, err := collection.Distinct(context.TODO(), "user_id", bson.M{"type": "chat"})
+	if err != nil {
+		log.Printf("Failed to list users for history trim: %v", err)
+		return
+	}
+
+	var trimmed int64
+	for _, id := range userIDs {
+		userID, ok := id.(int64)
+		if !ok {
+			continue
+		}
+
+		// Skip users with a chat turn in flight; they'll be picked up next tick.
+		mu := userLock(userID)
+		if !mu.TryLock() {
+			continue
+		}
+		n, err := trimChatHistory(collection, userID, maxMessages)
+		mu.Unlock()
+		if err != nil {
+			log.Printf("Failed to trim chat history for user %d: %v", userID, err)
+			continue
+		}
+		trimmed += n
+	}
+	if trimmed > 0 {
+		log.Printf("History trim removed %d old messages", trimmed)
+	}
+}
+
+// trimChatHistory caps every session of a user to maxMessages and returns
+// how many messages were removed.
+func trimChatHistory(collection *mongo.Collection, userID int64, maxMessages int) (int64, error) {
+	values, err := collection.Distinct(context.TODO(), "session", bson.M{"user_id": userID, "type": "chat"})
+	if err != nil {
+		return 0, err
+	}
+	sessions := map[string]bool{defaultSession: true}
+	for _, v := range values {
+		if name, ok := v.(string); ok {
+			sessions[name] = true
+		}
+	}
+
+	var removed int64
+	for session := range sessions {
+		n, err := trimSessionHistory(collection, userID, session, maxMessages)
+		if err != nil {
+			return removed, err
+		}
+		removed += n
+	}
+	return removed, nil
+}
+
+// trimSessionHistory deletes the oldest chat messages of a session beyond
+// maxMessages and returns how many were removed.
+func trimSessionHistory(collection *mongo.Collection, userID int64, session string, maxMessages int) (int64, error) {
+	filter := chatFilter(userID, session)
+	count, err := collection.CountDocuments(context.TODO(), filter)
+	if err != nil {
+		return 0, err
+	}
+	excess := count - int64(maxMessages)
+	if excess <= 0 {
+		return 0, nil
+	}
+
+	// Oldest first, in the order loadChatHistory reads them: insertion
+	// order alone is off for compaction summaries, imported messages and
+	// retried saves.
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}).
+		SetLimit(excess).
+		SetProjection(bson.M{"_id": 1})
+	cursor, err := collection.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(context.TODO())
+
+	var ids []interface{}
+	for cursor.Next(context.TODO()) {
+		var doc struct {
+			ID interface{} `bson:"_id"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return 0, err
+		}
+		ids = append(ids, doc.ID)
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	res, err := collection.DeleteMany(context.TODO(), bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
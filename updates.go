@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// exitTokenRevoked is the exit code used when Telegram keeps rejecting
+	// the bot token, so supervisors can tell it apart from a crash.
+	exitTokenRevoked = 3
+	// maxAuthFailures is how many consecutive 401 responses are tolerated
+	// before the token is considered revoked.
+	maxAuthFailures   = 3
+	updatesRetryDelay = 3 * time.Second
+)
+
+// pollUpdates long-polls Telegram for updates like GetUpdatesChan, but
+// exits with exitTokenRevoked once the token is rejected maxAuthFailures
+// times in a row instead of retrying silently forever.
+func pollUpdates(bot *tgbotapi.BotAPI, config tgbotapi.UpdateConfig) tgbotapi.UpdatesChannel {
+	ch := make(chan tgbotapi.Update, bot.Buffer)
+	go func() {
+		authFailures := 0
+		for {
+			updates, err := bot.GetUpdates(config)
+			if err != nil {
+				if isTelegramAuthError(err) {
+					authFailures++
+					if authFailures >= maxAuthFailures {
+						log.Printf("CRITICAL: Telegram rejected the bot token %d times in a row (%v). "+
+							"The token was probably revoked: rotate TELEGRAM_BOT_TOKEN and restart the bot.", authFailures, err)
+						os.Exit(exitTokenRevoked)
+					}
+				} else {
+					authFailures = 0
+				}
+				log.Printf("Failed to get updates, retrying in %s: %v", updatesRetryDelay, err)
+				time.Sleep(updatesRetryDelay)
+				continue
+			}
+			authFailures = 0
+
+			for _, update := range updates {
+				if update.UpdateID >= config.Offset {
+					config.Offset = update.UpdateID + 1
+					ch <- update
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+// isTelegramAuthError reports whether Telegram refused the bot token.
+func isTelegramAuthError(err error) bool {
+	var apiErr *tgbotapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusUnauthorized
+}
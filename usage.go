@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Usage is the token accounting returned with a completion.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// estimateCost prices usage with the model table. ok is false for models
+// without known pricing.
+func estimateCost(model string, usage Usage) (cost float64, ok bool) {
+	info, ok := lookupModel(model)
+	if !ok {
+		return 0, false
+	}
+	cost = (float64(usage.PromptTokens)*info.InputPrice + float64(usage.CompletionTokens)*info.OutputPrice) / 1e6
+	return cost, true
+}
+
+// recordUsage stores the usage of one request in a {type: "usage"}
+// document. Responses without usage are skipped.
+func recordUsage(collection *mongo.Collection, userID int64, resp *OpenAIResponse) {
+	if resp.Usage == nil {
+		return
+	}
+	cost, _ := estimateCost(resp.Model, *resp.Usage)
+	doc := struct {
+		UserID           int64     `bson:"user_id"`
+		Type             string    `bson:"type"`
+		Model            string    `bson:"model"`
+		PromptTokens     int       `bson:"prompt_tokens"`
+		CompletionTokens int       `bson:"completion_tokens"`
+		Cost             float64   `bson:"cost"` // USD, 0 for models without known pricing
+		CreatedAt        time.Time `bson:"created_at"`
+	}{
+		UserID:           userID,
+		Type:             "usage",
+		Model:            resp.Model,
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
+		Cost:             cost,
+		CreatedAt:        time.Now(),
+	}
+	if _, err := collection.InsertOne(context.TODO(), doc); err != nil {
+		log.Printf("Failed to record usage for user %d: %v", userID, err)
+	}
+	spendCap.add(cost)
+}
+
+// diagnosticsFooter renders the /verbose details of a reply: model,
+// tokens in and out, latency and finish reason.
+func diagnosticsFooter(resp *OpenAIResponse, latency time.Duration) string {
+	tokens := "tokens n/a"
+	if resp.Usage != nil {
+		tokens = fmt.Sprintf("tokens %d in / %d out", resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
+	}
+	finish := "n/a"
+	if len(resp.Choices) > 0 && resp.Choices[0].FinishReason != "" {
+		finish = resp.Choices[0].FinishReason
+	}
+	return fmt.Sprintf("⚙ %s · %s · %.1fs · finish: %s", resp.Model, tokens, latency.Seconds(), finish)
+}
+
+// usageFooter renders the model and, when usage is known, the estimated
+// cost of a reply.
+func usageFooter(lang string, resp *OpenAIResponse) string {
+	if resp.Usage != nil {
+		if cost, ok := estimateCost(resp.Model, *resp.Usage); ok {
+			return tr(lang, "footer_cost", resp.Model, cost)
+		}
+	}
+	return tr(lang, "footer_model", resp.Model)
+}
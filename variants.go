@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// variantTTL is how long the variants of a reply can still be picked.
+const variantTTL = 15 * time.Minute
+
+// pickCallbackPrefix starts the callback data of the pick buttons,
+// "pick:<set id>:<variant index>".
+const pickCallbackPrefix = "pick:"
+
+// variantSet is the candidate answers of one reply. The first one is
+// stored in history until another is picked.
+type variantSet struct {
+	id        int // request ID of the reply
+	session   string
+	storedAt  time.Time // created_at of the stored assistant message
+	variants  []string
+	expiresAt time.Time
+}
+
+var (
+	variantSetsMu sync.Mutex
+	variantSets   = map[int64]*variantSet{} // latest set per user
+)
+
+func rememberVariants(userID int64, set *variantSet) {
+	set.expiresAt = time.Now().Add(variantTTL)
+	variantSetsMu.Lock()
+	defer variantSetsMu.Unlock()
+	for id, s := range variantSets {
+		if time.Now().After(s.expiresAt) {
+			delete(variantSets, id)
+		}
+	}
+	variantSets[userID] = set
+}
+
+// takeVariant removes and returns the user's variant set. It fails with
+// the catalog key to reply with if the set has expired, is not the set
+// setID (unless that is zero) or has no such variant.
+func takeVariant(userID int64, setID, index int) (*variantSet, string, bool) {
+	variantSetsMu.Lock()
+	defer variantSetsMu.Unlock()
+	set, ok := variantSets[userID]
+	if !ok || time.Now().After(set.expiresAt) || (setID != 0 && set.id != setID) {
+		return nil, "pick_expired", false
+	}
+	if index < 0 || index >= len(set.variants) {
+		return nil, "pick_invalid", false
+	}
+	delete(variantSets, userID)
+	return set, "", true
+}
+
+// pickKeyboard offers one button per variant.
+func pickKeyboard(setID, count int) tgbotapi.InlineKeyboardMarkup {
+	var row []tgbotapi.InlineKeyboardButton
+	for i := 0; i < count; i++ {
+		data := fmt.Sprintf("%s%d:%d", pickCallbackPrefix, setID, i)
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(strconv.Itoa(i+1), data))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(row)
+}
+
+// pickVariant makes variant index of the user's set the stored assistant
+// turn, replacing the first variant saved with the reply. It returns the
+// catalog key of the outcome.
+func pickVariant(collection *mongo.Collection, userID int64, setID, index int) string {
+	set, key, ok := takeVariant(userID, setID, index)
+	if !ok {
+		return key
+	}
+	content, _ := capStoredContent(set.variants[index])
+	filter := bson.M{
+		"user_id":    userID,
+		"type":       "chat",
+		"session":    set.session,
+		"role":       "assistant",
+		"created_at": set.storedAt,
+	}
+	update := bson.M{"$set": bson.M{"content": content}}
+	result, err := collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf("Failed to store picked variant of user %d: %v", userID, err)
+		return "pick_error"
+	}
+	if result.MatchedCount == 0 {
+		// The reply was never saved, or the session was reset since.
+		return "pick_error"
+	}
+	return "pick_done"
+}
+
+func pickReply(lang, key string, index int) string {
+	if key == "pick_done" {
+		return tr(lang, key, index+1)
+	}
+	return tr(lang, key)
+}
+
+// handlePickCallback handles a press of a pick button.
+func handlePickCallback(bot *tgbotapi.BotAPI, collection *mongo.Collection, query *tgbotapi.CallbackQuery) {
+	prefs, err := getUserPrefs(collection, query.From.ID)
+	if err != nil {
+		log.Printf("Failed to load user prefs: %v", err)
+	}
+	lang := prefs.Lang
+	if _, ok := catalog[lang]; !ok {
+		lang = fallbackLang(query.From)
+	}
+
+	var setID, index int
+	if _, err := fmt.Sscanf(strings.TrimPrefix(query.Data, pickCallbackPrefix), "%d:%d", &setID, &index); err != nil {
+		bot.Request(tgbotapi.NewCallback(query.ID, ""))
+		return
+	}
+	key := pickVariant(collection, query.From.ID, setID, index)
+	reply := pickReply(lang, key, index)
+	bot.Request(tgbotapi.NewCallback(query.ID, reply))
+	if key == "pick_done" && query.Message != nil {
+		edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, reply)
+		if _, err := bot.Send(edit); err != nil {
+			log.Printf("Failed to update pick message: %v", err)
+		}
+	}
+}
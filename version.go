@@ -0,0 +1,54 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// version is the build version, set at build time with
+//
+//	go build -ldflags "-X main.version=v1.2.3"
+//
+// Builds without it report the VCS revision Go embeds, if any.
+var version = "dev"
+
+// startTime is when the process started, for /version.
+var startTime = time.Now()
+
+// buildVersion returns version, or for untagged builds the commit they
+// were built from.
+func buildVersion() string {
+	if version != "dev" {
+		return version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return version
+	}
+	var revision, modified string
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value
+		}
+	}
+	if revision == "" {
+		return version
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if modified == "true" {
+		revision += "-dirty"
+	}
+	return version + " (" + revision + ")"
+}
+
+// versionText renders /version: the build, the Go version and the uptime.
+func versionText(lang string) string {
+	uptime := time.Since(startTime).Truncate(time.Second)
+	return tr(lang, "version", buildVersion(), runtime.Version(), uptime, startTime.Format(time.RFC3339))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"ai_tg_bot/config"
+)
+
+// welcomeNewMembers greets the people who just joined a group with
+// GROUP_WELCOME, with {name} replaced by their names. Bots are not
+// greeted, and each group gets at most one welcome per
+// GROUP_WELCOME_INTERVAL, so a wave of joins doesn't flood the chat.
+func welcomeNewMembers(bot *tgbotapi.BotAPI, cfg *config.Config, message *tgbotapi.Message) {
+	if cfg.GroupWelcome == "" || !isGroupChat(message.Chat) {
+		return
+	}
+	var names []string
+	for _, member := range message.NewChatMembers {
+		if !member.IsBot {
+			names = append(names, member.FirstName)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	// The chat ID keys the cooldown just like a user ID would.
+	if checkCooldown(message.Chat.ID, "welcome", cfg.GroupWelcomeInterval) > 0 {
+		return
+	}
+	text := strings.ReplaceAll(cfg.GroupWelcome, "{name}", strings.Join(names, ", "))
+	if _, err := bot.Send(tgbotapi.NewMessage(message.Chat.ID, text)); err != nil {
+		log.Printf("Failed to welcome new members of chat %d: %v", message.Chat.ID, err)
+	}
+}